@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	blurhashSize        = 32 // edge of the thumbnail the hash is computed from
+	blurhashComponentsX = 4
+	blurhashComponentsY = 3
+	base83Digits        = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+)
+
+// blurhash encodes img as a BlurHash with the given number of components
+// along each axis, following the reference algorithm at blurha.sh.
+func blurhash(img image.Image, componentsX, componentsY int) string {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	factors := make([][3]float64, 0, componentsX*componentsY)
+	for j := range componentsY {
+		for i := range componentsX {
+			var factor [3]float64
+			for y := range height {
+				for x := range width {
+					basis := math.Cos(math.Pi*float64(i*x)/float64(width)) * math.Cos(math.Pi*float64(j*y)/float64(height))
+					r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+					factor[0] += basis * srgbToLinear(r>>8)
+					factor[1] += basis * srgbToLinear(g>>8)
+					factor[2] += basis * srgbToLinear(b>>8)
+				}
+			}
+			scale := 1.0
+			if i != 0 || j != 0 {
+				scale = 2
+			}
+			scale /= float64(width * height)
+			factors = append(factors, [3]float64{factor[0] * scale, factor[1] * scale, factor[2] * scale})
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(base83((componentsX-1)+(componentsY-1)*9, 1))
+	dc, ac := factors[0], factors[1:]
+	maximum := 1.0
+	if len(ac) > 0 {
+		actual := 0.0
+		for _, f := range ac {
+			actual = max(actual, math.Abs(f[0]), math.Abs(f[1]), math.Abs(f[2]))
+		}
+		quantised := int(max(0, min(82, math.Floor(actual*166-0.5))))
+		maximum = float64(quantised+1) / 166
+		hash.WriteString(base83(quantised, 1))
+	} else {
+		hash.WriteString(base83(0, 1))
+	}
+	hash.WriteString(base83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4))
+	for _, f := range ac {
+		quantise := func(v float64) int {
+			return int(max(0, min(18, math.Floor(signPow(v/maximum, 0.5)*9+9.5))))
+		}
+		hash.WriteString(base83(quantise(f[0])*19*19+quantise(f[1])*19+quantise(f[2]), 2))
+	}
+	return hash.String()
+}
+
+func base83(value, length int) string {
+	digits := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		digits[i] = base83Digits[value%83]
+		value /= 83
+	}
+	return string(digits)
+}
+
+func srgbToLinear(value uint32) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := max(0, min(1, value))
+	if v <= 0.0031308 {
+		return int(math.Round(v * 12.92 * 255))
+	}
+	return int(math.Round((1.055*math.Pow(v, 1/2.4) - 0.055) * 255))
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+// blurhashCache remembers computed hashes by source URL, evicting the
+// oldest entry once it holds size entries.
+type blurhashCache struct {
+	size  int
+	mu    sync.Mutex
+	items map[string]string
+	order []string
+}
+
+// blurhashes is sized from BLURHASH_CACHE_SIZE at startup and replaced
+// wholesale when the cache is flushed.
+var blurhashes atomic.Pointer[blurhashCache]
+
+func newBlurhashCache(size int) *blurhashCache {
+	return &blurhashCache{size: size, items: map[string]string{}}
+}
+
+func (c *blurhashCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hash, ok := c.items[key]
+	return hash, ok
+}
+
+func (c *blurhashCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.items)
+}
+
+func (c *blurhashCache) add(key, hash string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.items[key]; ok || c.size <= 0 {
+		return
+	}
+	if len(c.order) >= c.size {
+		delete(c.items, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.items[key] = hash
+	c.order = append(c.order, key)
+}
+
+// serveBlurhash answers ?blurhash=1 with the BlurHash of an image as JSON.
+// The resizer shrinks the source to a small PNG first, so decoding and
+// hashing stay cheap whatever the source size and format.
+func serveBlurhash(w http.ResponseWriter, r *http.Request, cfg *config, urlPath string, t target) {
+	cache := blurhashes.Load()
+	hash, ok := cache.get(t.sourceURL)
+	if !ok {
+		u, _ := url.Parse(cfg.resizerApiHost)
+		u.Path = fmt.Sprintf("/insecure/rs:fit:%d:%d/f:png/plain/%s", blurhashSize, blurhashSize, t.sourceURL)
+		thumb := target{url: u.String(), backend: backendResizer, resized: true}
+		resp, err := fetchAsset(r.Context(), thumb.url, thumb.backend, upstreamHeaders(r, cfg, thumb))
+		if err != nil {
+			writeError(w, r, http.StatusBadGateway, "Error fetching image")
+			return
+		}
+		defer resp.Body.Close()
+		img, _, err := image.Decode(io.LimitReader(resp.Body, 1<<20))
+		if err != nil || img.Bounds().Empty() {
+			writeError(w, r, http.StatusBadGateway, "Error decoding image")
+			return
+		}
+		hash = blurhash(img, blurhashComponentsX, blurhashComponentsY)
+		cache.add(t.sourceURL, hash)
+	}
+
+	body, _ := json.Marshal(map[string]string{"blurhash": hash})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", cacheControlFor(cfg, urlPath))
+	setCrossOriginHeaders(w.Header(), cfg)
+	t.vary.apply(w.Header())
+	writeBody(w, r, http.StatusOK, append(body, '\n'))
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBlurhash(t *testing.T) {
+	black := color.NRGBA{A: 255}
+	white := color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+	tests := []struct {
+		name                     string
+		width, height            int
+		c                        color.Color
+		componentsX, componentsY int
+		want                     string
+	}{
+		{"black", 8, 8, black, 4, 3, "L00000" + strings.Repeat("fQ", 11)},
+		{"black odd size", 5, 7, black, 4, 3, "L00000" + strings.Repeat("fQ", 11)},
+		{"black 1x1 components", 8, 8, black, 1, 1, "000000"},
+		{"white 1x1 components", 8, 8, white, 1, 1, "00TSUA"},
+		{"red 1x1 components", 4, 4, red, 1, 1, "00TI:j"},
+		{"black 9x9 components", 9, 9, black, 9, 9, "|00000" + strings.Repeat("fQ", 80)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := image.NewNRGBA(image.Rect(0, 0, tt.width, tt.height))
+			for y := range tt.height {
+				for x := range tt.width {
+					img.Set(x, y, tt.c)
+				}
+			}
+			if got := blurhash(img, tt.componentsX, tt.componentsY); got != tt.want {
+				t.Errorf("blurhash() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBlurhashSubImage(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	for y := range 8 {
+		for x := range 8 {
+			img.Set(x, y, red)
+		}
+	}
+	sub := img.SubImage(image.Rect(2, 2, 6, 6))
+	whole := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for y := range 4 {
+		for x := range 4 {
+			whole.Set(x, y, red)
+		}
+	}
+	if got, want := blurhash(sub, 4, 3), blurhash(whole, 4, 3); got != want {
+		t.Errorf("blurhash of offset image = %q, want %q", got, want)
+	}
+}
+
+func TestBase83(t *testing.T) {
+	tests := []struct {
+		value, length int
+		want          string
+	}{
+		{0, 1, "0"},
+		{82, 1, "~"},
+		{83, 2, "10"},
+		{3429, 2, "fQ"},
+		{16777215, 4, "TSUA"},
+	}
+	for _, tt := range tests {
+		if got := base83(tt.value, tt.length); got != tt.want {
+			t.Errorf("base83(%d, %d) = %q, want %q", tt.value, tt.length, got, tt.want)
+		}
+	}
+}
+
+func TestBlurhashCache(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		keys     []string
+		wantKeys []string
+		wantGone []string
+	}{
+		{"under size", 3, []string{"a", "b"}, []string{"a", "b"}, nil},
+		{"evicts oldest", 2, []string{"a", "b", "c"}, []string{"b", "c"}, []string{"a"}},
+		{"duplicate ignored", 2, []string{"a", "a", "b"}, []string{"a", "b"}, nil},
+		{"disabled", 0, []string{"a"}, nil, []string{"a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newBlurhashCache(tt.size)
+			for _, key := range tt.keys {
+				c.add(key, "hash-"+key)
+			}
+			for _, key := range tt.wantKeys {
+				if hash, ok := c.get(key); !ok || hash != "hash-"+key {
+					t.Errorf("get(%q) = %q, %v", key, hash, ok)
+				}
+			}
+			for _, key := range tt.wantGone {
+				if _, ok := c.get(key); ok {
+					t.Errorf("%q still cached", key)
+				}
+			}
+			if c.len() != len(tt.wantKeys) {
+				t.Errorf("len() = %d, want %d", c.len(), len(tt.wantKeys))
+			}
+		})
+	}
+}
+
+func TestBlurhashEndpoint(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        map[string]string
+		thumb      []byte
+		wantStatus int
+		wantHash   string
+		wantVary   string
+	}{
+		{"black", nil, solidPNG(t, blurhashSize, blurhashSize, color.NRGBA{A: 255}), http.StatusOK, "L00000" + strings.Repeat("fQ", 11), ""},
+		{"hotlink protected", map[string]string{"HOTLINK_ALLOWED_HOSTS": "example.com"}, solidPNG(t, blurhashSize, blurhashSize, color.NRGBA{A: 255}), http.StatusOK, "L00000" + strings.Repeat("fQ", 11), "Referer, Origin"},
+		{"not an image", nil, []byte("nope"), http.StatusBadGateway, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resized []string
+			backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasPrefix(r.URL.Path, "/insecure/") {
+					resized = append(resized, r.URL.Path)
+				}
+				w.Write(tt.thumb)
+			})
+			cfg := testConfig(t, backend.URL, tt.env)
+
+			for range 2 {
+				req := httptest.NewRequest(http.MethodGet, "/assets/photo.jpg?blurhash=1", nil)
+				req.Header.Set("Referer", "https://example.com/")
+				rec := serve(cfg, nil, req)
+				if rec.Code != tt.wantStatus {
+					t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+				}
+				if tt.wantStatus != http.StatusOK {
+					continue
+				}
+				if got := rec.Header().Get("Vary"); got != tt.wantVary {
+					t.Errorf("Vary = %q, want %q", got, tt.wantVary)
+				}
+				var body map[string]string
+				if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+					t.Fatal(err)
+				}
+				if body["blurhash"] != tt.wantHash {
+					t.Errorf("blurhash = %q, want %q", body["blurhash"], tt.wantHash)
+				}
+			}
+
+			wantCalls := 1
+			if tt.wantStatus != http.StatusOK {
+				wantCalls = 2 // failures are not cached
+			}
+			if len(resized) != wantCalls {
+				t.Fatalf("resizer called %d times, want %d", len(resized), wantCalls)
+			}
+			if !strings.HasPrefix(resized[0], "/insecure/rs:fit:32:32/f:png/plain/") {
+				t.Errorf("resizer path = %q", resized[0])
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+var errBudgetExhausted = errors.New("request budget exhausted")
+
+type budgetKey struct{}
+
+// withBudget limits the total time all backend attempts made with ctx may
+// spend waiting for response headers, across retries, fallbacks and
+// precompressed lookups. Reading a body once headers have arrived is not
+// limited, so long downloads are unaffected.
+func withBudget(ctx context.Context, budget time.Duration) context.Context {
+	if budget <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, budgetKey{}, time.Now().Add(budget))
+}
+
+// attemptContext returns the context for one backend attempt. It is
+// cancelled if the budget runs out before the attempt gets its response;
+// the returned stop function must be called once it has, so the body can
+// still be streamed. errBudgetExhausted is returned when nothing is left.
+func attemptContext(ctx context.Context) (context.Context, func(), error) {
+	deadline, ok := ctx.Value(budgetKey{}).(time.Time)
+	if !ok {
+		return ctx, func() {}, nil
+	}
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return nil, nil, errBudgetExhausted
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	timer := time.AfterFunc(remaining, cancel)
+	return ctx, func() { timer.Stop() }, nil
+}
+
+// requestBudget attaches a REQUEST_BUDGET to every request.
+func requestBudget(budget time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(withBudget(r.Context(), budget)))
+		})
+	}
+}
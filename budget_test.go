@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAttemptContext(t *testing.T) {
+	tests := []struct {
+		name    string
+		budget  time.Duration
+		wait    time.Duration
+		wantErr error
+	}{
+		{"no budget", 0, 0, nil},
+		{"within budget", time.Second, 0, nil},
+		{"exhausted", 10 * time.Millisecond, 20 * time.Millisecond, errBudgetExhausted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := withBudget(context.Background(), tt.budget)
+			time.Sleep(tt.wait)
+			attempt, stop, err := attemptContext(ctx)
+			if err != tt.wantErr {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer stop()
+			if attempt.Err() != nil {
+				t.Errorf("attempt context already done: %v", attempt.Err())
+			}
+		})
+	}
+}
+
+func TestRequestBudget(t *testing.T) {
+	tests := []struct {
+		name         string
+		budget       time.Duration
+		primaryDelay time.Duration
+		bodyDelay    time.Duration
+		wantStatus   int
+		wantBody     string
+		maxElapsed   time.Duration
+	}{
+		{"fast primary", time.Second, 0, 0, http.StatusOK, "primary", time.Second},
+		{"slow primary within budget", time.Second, 50 * time.Millisecond, 0, http.StatusOK, "primary", time.Second},
+		{"slow primary exhausts budget", 50 * time.Millisecond, 500 * time.Millisecond, 0, http.StatusInternalServerError, "", 400 * time.Millisecond},
+		{"slow body not limited", 50 * time.Millisecond, 0, 100 * time.Millisecond, http.StatusOK, "primary", time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-time.After(tt.primaryDelay):
+				case <-r.Context().Done():
+					return
+				}
+				w.Write([]byte("pri"))
+				w.(http.Flusher).Flush()
+				time.Sleep(tt.bodyDelay)
+				w.Write([]byte("mary"))
+			})
+			fallback := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("fallback"))
+			})
+			cfg := testConfig(t, primary.URL, map[string]string{"ASSETS_FALLBACK_HOSTS": fallback.URL})
+			req := httptest.NewRequest(http.MethodGet, "/assets/a.txt", nil)
+			req = req.WithContext(withBudget(req.Context(), tt.budget))
+
+			start := time.Now()
+			rec := serve(cfg, nil, req)
+			elapsed := time.Since(start)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rec.Body, tt.wantBody)
+			}
+			if elapsed > tt.maxElapsed {
+				t.Errorf("answered after %v, want at most %v", elapsed, tt.maxElapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// bufferLimit decides whether a response is buffered before it is sent and
+// returns the maximum number of bytes to buffer, or 0 to stream it.
+// Content types matching BUFFER_CONTENT_TYPES are buffered up to
+// BUFFER_MAX_SIZE; HTTP/1.0 clients, which cannot parse chunked encoding,
+// get bodies of unknown length buffered up to HTTP10_BUFFER_SIZE, and with
+// GENERATE_ETAGS other chunked bodies are buffered up to BUFFER_MAX_SIZE so
+// they can be hashed. Bodies over the limit are streamed.
+func bufferLimit(cfg *config, r *http.Request, resp *http.Response, mediaType string) int64 {
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = mediaType
+	}
+	for _, prefix := range cfg.bufferContentTypes {
+		if strings.HasPrefix(strings.ToLower(contentType), strings.ToLower(prefix)) {
+			return cfg.bufferMaxSize
+		}
+	}
+	if !r.ProtoAtLeast(1, 1) && resp.ContentLength < 0 {
+		return cfg.http10BufferSize
+	}
+	if cfg.generateETags && resp.ContentLength < 0 {
+		return cfg.bufferMaxSize
+	}
+	return 0
+}
+
+// bufferBody reads up to limit bytes of the response body into memory. If
+// the whole body fit, resp.Body is replaced with the buffer,
+// resp.ContentLength and the Content-Length header are set, and it returns
+// true. Otherwise resp.Body still yields the complete body and it returns
+// false.
+func bufferBody(resp *http.Response, limit int64) (bool, error) {
+	buf, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return false, err
+	}
+	if int64(len(buf)) > limit {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), resp.Body), resp.Body}
+		return false, nil
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(buf))
+	resp.ContentLength = int64(len(buf))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(buf)))
+	return true, nil
+}
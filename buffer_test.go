@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// chunkedBackend streams body in two flushed writes so it arrives without a
+// Content-Length.
+func chunkedBackend(t *testing.T, contentType, body string) *httptest.Server {
+	return newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		half := len(body) / 2
+		w.Write([]byte(body[:half]))
+		w.(http.Flusher).Flush()
+		w.Write([]byte(body[half:]))
+	})
+}
+
+func TestHTTP10Buffering(t *testing.T) {
+	body := strings.Repeat("0123456789", 10)
+	tests := []struct {
+		name       string
+		env        map[string]string
+		minor      int
+		wantLength string
+		wantClose  bool
+	}{
+		{"http/1.0 buffered", nil, 0, "100", false},
+		{"http/1.0 over limit", map[string]string{"HTTP10_BUFFER_SIZE": "50"}, 0, "", true},
+		{"http/1.1 streamed", nil, 1, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := chunkedBackend(t, "text/plain", body)
+			cfg := testConfig(t, backend.URL, tt.env)
+			req := httptest.NewRequest(http.MethodGet, "/assets/a.txt", nil)
+			req.Proto, req.ProtoMinor = fmt.Sprintf("HTTP/1.%d", tt.minor), tt.minor
+			rec := serve(cfg, nil, req)
+
+			if rec.Body.String() != body {
+				t.Errorf("body = %q, want %q", rec.Body, body)
+			}
+			if got := rec.Header().Get("Content-Length"); got != tt.wantLength {
+				t.Errorf("Content-Length = %q, want %q", got, tt.wantLength)
+			}
+			if got := rec.Header().Get("Connection") == "close"; got != tt.wantClose {
+				t.Errorf("Connection: close = %v, want %v", got, tt.wantClose)
+			}
+		})
+	}
+}
+
+func TestBufferContentTypes(t *testing.T) {
+	body := strings.Repeat("0123456789", 10)
+	tests := []struct {
+		name        string
+		env         map[string]string
+		contentType string
+		wantLength  string
+	}{
+		{"image buffered by default", nil, "image/png", "100"},
+		{"text streamed by default", nil, "text/plain", ""},
+		{"configured type", map[string]string{"BUFFER_CONTENT_TYPES": "text/, application/json"}, "application/json", "100"},
+		{"case-insensitive", map[string]string{"BUFFER_CONTENT_TYPES": "Text/"}, "text/plain", "100"},
+		{"over the limit", map[string]string{"BUFFER_MAX_SIZE": "99"}, "image/png", ""},
+		{"at the limit", map[string]string{"BUFFER_MAX_SIZE": "100"}, "image/png", "100"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := chunkedBackend(t, tt.contentType, body)
+			cfg := testConfig(t, backend.URL, tt.env)
+			rec := serve(cfg, nil, httptest.NewRequest(http.MethodGet, "/assets/blob", nil))
+
+			if rec.Body.String() != body {
+				t.Errorf("body = %q, want %q", rec.Body, body)
+			}
+			if got := rec.Header().Get("Content-Length"); got != tt.wantLength {
+				t.Errorf("Content-Length = %q, want %q", got, tt.wantLength)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gzipLevel and gzipMinSize configure writeBody, set from GZIP_LEVEL and
+// GZIP_MIN_SIZE at startup. Bodies smaller than gzipMinSize are sent
+// uncompressed since the gzip framing would outweigh the savings.
+var (
+	gzipLevel   = gzip.DefaultCompression
+	gzipMinSize = 1024
+)
+
+// acceptsEncoding reports whether the request's Accept-Encoding allows the
+// given content coding, honoring explicit q=0 refusals.
+func acceptsEncoding(r *http.Request, coding string) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), coding) && strings.TrimSpace(name) != "*" {
+			continue
+		}
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+		return q > 0
+	}
+	return false
+}
+
+// writeBody writes a fully buffered response body, gzip-encoding it when the
+// client accepts gzip and the body is at least gzipMinSize bytes. Headers
+// other than the encoding ones must already be set.
+func writeBody(w http.ResponseWriter, r *http.Request, status int, body []byte) {
+	compressible := len(body) >= gzipMinSize
+	if compressible {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	if !compressible || !acceptsEncoding(r, "gzip") {
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(status)
+		w.Write(body)
+		return
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(status)
+	gz, _ := gzip.NewWriterLevel(w, gzipLevel)
+	gz.Write(body)
+	gz.Close()
+}
+
+// gzipStream reports whether a backend response should be gzip-encoded on
+// the way through. Only types listed in COMPRESS_TYPES qualify, and the
+// upstream Content-Length decides the rest without buffering: bodies
+// declared smaller than gzipMinSize are sent as they are, while large or
+// unknown lengths are compressed. Byte ranges, already encoded bodies and
+// anything the client or backend marked no-transform are never touched.
+func gzipStream(r *http.Request, cfg *config, resp *http.Response, contentType string, vary *varySet) bool {
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "" && !resp.Uncompressed {
+		return false
+	}
+	if hasCacheDirective(r.Header, "no-transform") || hasCacheDirective(resp.Header, "no-transform") {
+		return false
+	}
+	matched := false
+	for _, prefix := range cfg.compressTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			matched = true
+			break
+		}
+	}
+	if !matched || resp.ContentLength >= 0 && resp.ContentLength < int64(gzipMinSize) {
+		return false
+	}
+	vary.add("Accept-Encoding")
+	return acceptsEncoding(r, "gzip")
+}
+
+// fetchPrecompressed tries the brotli variant stored next to an asset as
+// <path>.br when the client accepts br. It returns nil when the variant is
+// not applicable or missing, in which case the original is fetched as
+// usual. Range requests always use the original so byte offsets match.
+func fetchPrecompressed(r *http.Request, cfg *config, t target) (*http.Response, string) {
+	if t.resized || hasCompressionSuffix(t.url) || r.Header.Get("Range") != "" || !acceptsEncoding(r, "br") {
+		return nil, ""
+	}
+	resp, err := fetchAsset(r.Context(), t.url+".br", t.backend, upstreamHeaders(r, cfg, t))
+	if err != nil {
+		return nil, ""
+	}
+	return resp, "br"
+}
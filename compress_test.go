@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		coding string
+		want   bool
+	}{
+		{"", "gzip", false},
+		{"gzip", "gzip", true},
+		{"GZIP", "gzip", true},
+		{"deflate, gzip;q=0.5", "gzip", true},
+		{"gzip;q=0", "gzip", false},
+		{"gzip; q=0.0", "gzip", false},
+		{"*", "gzip", true},
+		{"*;q=0", "br", false},
+		{"br", "gzip", false},
+		{"gzip, br", "br", true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", tt.header)
+		if got := acceptsEncoding(r, tt.coding); got != tt.want {
+			t.Errorf("acceptsEncoding(%q, %q) = %v, want %v", tt.header, tt.coding, got, tt.want)
+		}
+	}
+}
+
+func TestWriteErrorGzip(t *testing.T) {
+	level, minSize := gzipLevel, gzipMinSize
+	t.Cleanup(func() { gzipLevel, gzipMinSize = level, minSize })
+	gzipLevel, gzipMinSize = gzip.DefaultCompression, 0
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		wantGzip       bool
+	}{
+		{"accepted", "gzip, deflate", true},
+		{"not accepted", "", false},
+		{"refused", "gzip;q=0", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/assets/x", nil)
+			r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			rec := httptest.NewRecorder()
+			writeError(rec, r, http.StatusNotFound, "not found")
+
+			if rec.Code != http.StatusNotFound {
+				t.Errorf("status = %d, want 404", rec.Code)
+			}
+			if got := rec.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", got)
+			}
+			var body io.Reader = rec.Body
+			if gzipped := rec.Header().Get("Content-Encoding") == "gzip"; gzipped != tt.wantGzip {
+				t.Fatalf("gzipped = %v, want %v", gzipped, tt.wantGzip)
+			}
+			if tt.wantGzip {
+				gz, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = gz
+			} else if rec.Header().Get("Content-Length") == "" {
+				t.Error("Content-Length missing on the plain body")
+			}
+			var decoded map[string]string
+			if err := json.NewDecoder(body).Decode(&decoded); err != nil {
+				t.Fatal(err)
+			}
+			if decoded["error"] != "not found" {
+				t.Errorf("error = %q, want %q", decoded["error"], "not found")
+			}
+		})
+	}
+}
+
+func TestGzipLevel(t *testing.T) {
+	level, minSize := gzipLevel, gzipMinSize
+	t.Cleanup(func() { gzipLevel, gzipMinSize = level, minSize })
+	gzipMinSize = 0
+
+	body := []byte(strings.Repeat(`{"name":"asset","size":1024},`, 200))
+	sizes := map[int]int{}
+	for _, level := range []int{gzip.HuffmanOnly, gzip.NoCompression, gzip.BestSpeed, 6, gzip.BestCompression} {
+		t.Run(strconv.Itoa(level), func(t *testing.T) {
+			gzipLevel = level
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Accept-Encoding", "gzip")
+			rec := httptest.NewRecorder()
+			writeBody(rec, r, http.StatusOK, body)
+
+			sizes[level] = rec.Body.Len()
+			gz, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(gz)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, body) {
+				t.Error("body did not round-trip")
+			}
+		})
+	}
+	if sizes[gzip.BestCompression] >= sizes[gzip.NoCompression] {
+		t.Errorf("level 9 wrote %d bytes, level 0 %d", sizes[gzip.BestCompression], sizes[gzip.NoCompression])
+	}
+}
+
+func TestPrecompressed(t *testing.T) {
+	on := map[string]string{"PRECOMPRESSED": "true"}
+	tests := []struct {
+		name           string
+		env            map[string]string
+		path           string
+		acceptEncoding string
+		rangeHeader    string
+		wantBody       string
+		wantEncoding   string
+		wantType       string // checked when not empty
+		wantVary       string
+	}{
+		{"variant", on, "style.css", "gzip, br", "", "BROTLI", "br", "text/css; charset=utf-8", "Accept-Encoding"},
+		{"br not accepted", on, "style.css", "gzip", "", "plain", "", "", "Accept-Encoding"},
+		{"br refused", on, "style.css", "br;q=0", "", "plain", "", "", "Accept-Encoding"},
+		{"variant missing", on, "app.js", "br", "", "plain", "", "", "Accept-Encoding"},
+		{"range", on, "style.css", "br", "bytes=0-1", "pl", "", "", "Accept-Encoding"},
+		{"explicit br", on, "style.css.br", "br", "", "BROTLI", "br", "text/css; charset=utf-8", "Accept-Encoding"},
+		{"explicit br not accepted", on, "style.css.br", "", "", "BROTLI", "", "", "Accept-Encoding"},
+		{"disabled", nil, "style.css", "br", "", "plain", "", "", ""},
+		{"disabled explicit br", nil, "style.css.br", "br", "", "BROTLI", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/assets/style.css.br":
+					w.Write([]byte("BROTLI"))
+				case "/assets/style.css", "/assets/app.js":
+					http.ServeContent(w, r, "", time.Time{}, strings.NewReader("plain"))
+				default:
+					http.NotFound(w, r)
+				}
+			})
+			cfg := testConfig(t, backend.URL, tt.env)
+			req := httptest.NewRequest(http.MethodGet, "/assets/"+tt.path, nil)
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			if tt.rangeHeader != "" {
+				req.Header.Set("Range", tt.rangeHeader)
+			}
+			rec := serve(cfg, nil, req)
+
+			if rec.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rec.Body, tt.wantBody)
+			}
+			if got := rec.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+			if got := rec.Header().Get("Content-Type"); tt.wantType != "" && got != tt.wantType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantType)
+			}
+			if got := rec.Header().Get("Vary"); got != tt.wantVary {
+				t.Errorf("Vary = %q, want %q", got, tt.wantVary)
+			}
+		})
+	}
+}
+
+func TestGzipMinSize(t *testing.T) {
+	level, minSize := gzipLevel, gzipMinSize
+	t.Cleanup(func() { gzipLevel, gzipMinSize = level, minSize })
+	gzipLevel, gzipMinSize = gzip.DefaultCompression, 100
+
+	tests := []struct {
+		name           string
+		size           int
+		acceptEncoding string
+		wantGzip       bool
+		wantVary       string
+	}{
+		{"small", 99, "gzip", false, ""},
+		{"at threshold", 100, "gzip", true, "Accept-Encoding"},
+		{"large", 1000, "gzip", true, "Accept-Encoding"},
+		{"large not accepted", 1000, "", false, "Accept-Encoding"},
+		{"small not accepted", 10, "", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			rec := httptest.NewRecorder()
+			writeBody(rec, r, http.StatusOK, bytes.Repeat([]byte("a"), tt.size))
+
+			if got := rec.Header().Get("Content-Encoding") == "gzip"; got != tt.wantGzip {
+				t.Errorf("gzipped = %v, want %v", got, tt.wantGzip)
+			}
+			if got := rec.Header().Get("Vary"); got != tt.wantVary {
+				t.Errorf("Vary = %q, want %q", got, tt.wantVary)
+			}
+			if !tt.wantGzip && rec.Header().Get("Content-Length") != strconv.Itoa(tt.size) {
+				t.Errorf("Content-Length = %q, want %d", rec.Header().Get("Content-Length"), tt.size)
+			}
+		})
+	}
+}
+
+func TestGzipStream(t *testing.T) {
+	minSize := gzipMinSize
+	t.Cleanup(func() { gzipMinSize = minSize })
+	gzipMinSize = 100
+
+	cfg := &config{compressTypes: []string{"text/", "application/json"}}
+	tests := []struct {
+		name           string
+		contentType    string
+		length         int64
+		status         int
+		header         map[string]string
+		acceptEncoding string
+		want           bool
+		wantVary       bool
+	}{
+		{"text", "text/css", 1000, http.StatusOK, nil, "gzip", true, true},
+		{"json unknown length", "application/json", -1, http.StatusOK, nil, "gzip", true, true},
+		{"not accepted", "text/css", 1000, http.StatusOK, nil, "br", false, true},
+		{"small", "text/css", 99, http.StatusOK, nil, "gzip", false, false},
+		{"type not listed", "image/png", 1000, http.StatusOK, nil, "gzip", false, false},
+		{"partial content", "text/css", 1000, http.StatusPartialContent, nil, "gzip", false, false},
+		{"already encoded", "text/css", 1000, http.StatusOK, map[string]string{"Content-Encoding": "br"}, "gzip", false, false},
+		{"no-transform", "text/css", 1000, http.StatusOK, map[string]string{"Cache-Control": "public, no-transform"}, "gzip", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/assets/a", nil)
+			r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			resp := &http.Response{StatusCode: tt.status, ContentLength: tt.length, Header: http.Header{}}
+			for name, value := range tt.header {
+				resp.Header.Set(name, value)
+			}
+			var vary varySet
+
+			if got := gzipStream(r, cfg, resp, tt.contentType, &vary); got != tt.want {
+				t.Errorf("gzipStream() = %v, want %v", got, tt.want)
+			}
+			if got := len(vary) > 0; got != tt.wantVary {
+				t.Errorf("Vary added = %v, want %v", got, tt.wantVary)
+			}
+		})
+	}
+}
+
+func TestGzipStreamedAsset(t *testing.T) {
+	body := strings.Repeat("body { color: red }\n", 100)
+	backend := chunkedBackend(t, "text/css", body)
+	cfg := testConfig(t, backend.URL, map[string]string{"COMPRESS_TYPES": "text/"})
+	req := httptest.NewRequest(http.MethodGet, "/assets/site.css", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	rec := serve(cfg, nil, req)
+
+	if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", got)
+	}
+	if got := rec.Header().Get("Content-Length"); got != "" {
+		t.Errorf("Content-Length = %q, want none", got)
+	}
+	r, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := io.ReadAll(r); string(data) != body {
+		t.Errorf("body = %q, want the backend body", data)
+	}
+}
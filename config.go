@@ -0,0 +1,669 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/tls"
+	"log"
+	"mime"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+const (
+	duplicateParamsFirst  = "first"
+	duplicateParamsReject = "reject"
+
+	getBodyIgnore = "ignore"
+	getBodyDrain  = "drain"
+	getBodyReject = "reject"
+)
+
+// config holds the settings read from the environment at startup.
+type config struct {
+	assetsApiHost  string
+	resizerApiHost string
+
+	// duplicateParams controls how repeated query parameters such as
+	// ?w=100&w=200 are handled: "first" uses the first value, "reject"
+	// answers 400.
+	duplicateParams string
+
+	// immutableHeader names the backend response header that marks an
+	// asset as immutable, adding the directive to Cache-Control.
+	immutableHeader string
+
+	// debugToken enables the /debug endpoints when set; requests must send
+	// it as a bearer token. debugErrors is the size of the error ring buffer.
+	debugToken  string
+	debugErrors int
+
+	// resizableTypes are the source media types that may be sent to the
+	// resizer with type=image.
+	resizableTypes []string
+
+	// enableTestHooks turns on QA-only request parameters such as __delay.
+	// It must never be set in production.
+	enableTestHooks bool
+
+	// requestIDHeaders are the header names under which the request ID is
+	// forwarded to backends.
+	requestIDHeaders []string
+
+	// maxDataURLSize caps the decoded size of data: URL assets in bytes.
+	maxDataURLSize int
+
+	// gzipLevel is the compression level used for gzip-encoded responses;
+	// bodies under gzipMinSize bytes are not compressed.
+	gzipLevel   int
+	gzipMinSize int
+
+	// backendHeaders are static headers sent to each backend, keyed by
+	// backendAssets or backendResizer. A Host entry overrides the request
+	// host for virtual hosting.
+	backendHeaders map[string]http.Header
+
+	// maxConcurrent limits in-flight asset requests (0 disables the limit).
+	// Up to queueDepth further requests wait at most queueTimeout for a slot.
+	maxConcurrent int
+	queueDepth    int
+	queueTimeout  time.Duration
+
+	// autoQuality is the resizer autoquality method used for ?aq=1, e.g.
+	// "dssim". Empty disables the option.
+	autoQuality string
+
+	// maxIdleConnsPerHost sizes the pool of keep-alive connections kept for
+	// each backend host.
+	maxIdleConnsPerHost int
+
+	// canonicalHost, when set, is the only host assets are served on;
+	// requests for any other host are redirected to it.
+	canonicalHost string
+
+	// maxResizeOptions caps the processing options sent to the resizer for
+	// a single request.
+	maxResizeOptions int
+
+	// extensionTTLs overrides the default one-year max-age per file
+	// extension, keyed by lower-case extension with the leading dot.
+	extensionTTLs map[string]time.Duration
+
+	// canonicalLinks adds a Link rel="canonical" header pointing resized
+	// variants at the unresized asset.
+	canonicalLinks bool
+
+	// http10BufferSize bounds how much of a body of unknown length is
+	// buffered to give HTTP/1.0 clients a Content-Length.
+	http10BufferSize int64
+
+	// Sprite sheet defaults and limits for /sprite.
+	spriteMaxIcons    int
+	spriteMaxIconSize int64
+	spriteLayout      string
+	spritePadding     int
+	// spriteMaxIconDimension and spriteMaxSheetDimension bound decoded
+	// pixels, which a small compressed file can declare in huge numbers.
+	spriteMaxIconDimension  int
+	spriteMaxSheetDimension int
+
+	// precompressed serves <path>.br from the asset backend to clients that
+	// accept brotli.
+	precompressed bool
+
+	// bufferContentTypes are content type prefixes whose responses are
+	// read into memory, up to bufferMaxSize bytes, before being sent.
+	bufferContentTypes []string
+	bufferMaxSize      int64
+
+	// allowedResizeOptions restricts the resizer options callers may use,
+	// by short name (w, h, dpr, aq, ra, g, mb, webpo). Empty allows all.
+	allowedResizeOptions []string
+
+	// emptyAsNoContent answers 204 instead of 200 when the backend returns
+	// an empty body.
+	emptyAsNoContent bool
+
+	// resizeTimeout, when set, is how long to wait for the resizer before
+	// serving the original image with a resizeFallbackTTL max-age instead.
+	resizeTimeout     time.Duration
+	resizeFallbackTTL time.Duration
+
+	// overrideSecret enables per-request asset backend overrides signed with
+	// it and sent in overrideHeader, limited to the overrideHosts allowlist.
+	overrideHeader string
+	overrideSecret string
+	overrideHosts  []string
+
+	// resourcePolicy is the Cross-Origin-Resource-Policy sent with assets.
+	resourcePolicy string
+
+	// strictSniffing rejects assets whose extension claims an image but
+	// whose content sniffs as HTML, XML or an executable.
+	strictSniffing bool
+
+	// maxRequestsPerIP caps concurrent requests per client IP (0 disables).
+	// Clients behind trustedProxies are identified by X-Forwarded-For.
+	maxRequestsPerIP int
+	trustedProxies   []netip.Prefix
+	// maxConnsPerIP caps open connections per peer address (0 disables).
+	// Trusted proxies are exempt, as they carry many clients' connections.
+	maxConnsPerIP int
+
+	// fallbackHosts are asset backends tried in order when the primary
+	// answers 404 or 5xx, for paths under fallbackPrefixes (all if empty).
+	fallbackHosts    []string
+	fallbackPrefixes []string
+
+	// resizedHeader, when set, names a response header reporting whether
+	// the resizer produced the response.
+	resizedHeader string
+
+	// maintenanceFile turns on maintenance mode while it exists: asset
+	// requests get a 503 with maintenanceMessage and maintenanceRetryAfter.
+	maintenanceFile       string
+	maintenanceMessage    string
+	maintenanceRetryAfter time.Duration
+
+	// resizePresets maps ?preset= names to the query parameters they stand
+	// for, e.g. RESIZE_PRESETS="thumbnail=type=image&w=200&h=200;hero=...".
+	resizePresets map[string]url.Values
+
+	// localAssetsDir is served from when every asset backend failed for a
+	// relative, unresized path.
+	localAssetsDir string
+
+	// requestBudget bounds the total time one request may wait on backends
+	// across all of its attempts (0 disables).
+	requestBudget time.Duration
+
+	// resizeMinSourceSize skips the resizer for sources of at most this
+	// many bytes, found with a HEAD request (0 always resizes).
+	resizeMinSourceSize int64
+
+	// nelReportURL enables Network Error Logging, asking browsers to send
+	// failed asset loads to this collector for nelMaxAge.
+	nelReportURL string
+	nelMaxAge    time.Duration
+
+	// variantWidths enables /manifest, listing which of these pre-rendered
+	// widths exist for an asset under variantNameFormat.
+	variantWidths     []int
+	variantNameFormat string
+
+	// lastModifiedHeader names a backend header to derive Last-Modified
+	// from when the backend omits it; lastModifiedEpoch is used for
+	// immutable assets that carry neither.
+	lastModifiedHeader string
+	lastModifiedEpoch  time.Time
+
+	// denyPaths answers matching asset paths, typically scanner probes,
+	// with 404 without contacting a backend.
+	denyPaths *regexp.Regexp
+	// logDenied logs each denied path, for debugging DENY_PATHS only since
+	// scanners produce a lot of them.
+	logDenied bool
+
+	// compressTypes are content type prefixes whose backend responses are
+	// gzipped for clients that accept it.
+	compressTypes []string
+
+	// getBody controls GET and HEAD requests that carry a body: ignore
+	// them, drain up to getBodyMaxSize bytes before handling, or reject.
+	getBody        string
+	getBodyMaxSize int64
+
+	// transformers names the registered Transformers applied to matching
+	// responses of at most transformMaxSize bytes.
+	transformers     []string
+	transformMaxSize int64
+
+	// serverTiming adds a Server-Timing header breaking asset requests
+	// down into fetch, transform and total time.
+	serverTiming bool
+
+	// hotlinkAllowedHosts enables hotlink protection for images: the
+	// Referer or Origin must be one of these domains or a subdomain.
+	hotlinkAllowedHosts []string
+	hotlinkAllowEmpty   bool
+
+	// caseInsensitiveParams accepts known query parameters in any case.
+	caseInsensitiveParams bool
+
+	// generateETags adds ETags to asset responses, hashing bodies that
+	// are buffered and deriving weak ones for streamed bodies.
+	generateETags bool
+
+	// noStorePrefixes are asset path prefixes, such as private/, whose
+	// responses are marked no-store regardless of other cache settings.
+	noStorePrefixes []string
+
+	// maxFetchesPerHost caps concurrent fetches from each upstream host so
+	// a slow host cannot starve the others (0 disables). A fetch waits at
+	// most fetchQueueTimeout for a slot.
+	maxFetchesPerHost int
+	fetchQueueTimeout time.Duration
+
+	// shieldURL routes asset requests through an origin shield running
+	// this proxy; shieldHeader marks forwarded requests to prevent loops.
+	shieldURL    string
+	shieldHeader string
+
+	// trackingParams are query parameters, such as utm_*, removed before
+	// the request is resolved so shared links do not fragment caches.
+	trackingParams []string
+
+	// blurhashCacheSize bounds how many ?blurhash=1 results are kept.
+	blurhashCacheSize int
+
+	// maxHeaderBytes and maxBodySize bound the request headers and body
+	// accepted on every route. net/http allows 4 KiB of slack on top of
+	// maxHeaderBytes before answering 431.
+	maxHeaderBytes int
+	maxBodySize    int64
+
+	// permissionsPolicy, frameOptions and referrerPolicy are sent with
+	// HTML, SVG and XML responses; "none" leaves a header out.
+	permissionsPolicy string
+	frameOptions      string
+	referrerPolicy    string
+
+	// noSniff sends X-Content-Type-Options: nosniff on every response.
+	noSniff bool
+
+	// clientCerts are the certificates presented to backends that
+	// require mutual TLS, keyed like backendHeaders.
+	clientCerts map[string]*tls.Certificate
+
+	// normalizeOrientation has the resizer auto-rotate images and strip
+	// their metadata so output always has the default orientation.
+	normalizeOrientation bool
+
+	// contentTypes overrides the content type served for file extensions.
+	contentTypes map[string]string
+}
+
+func loadConfig() *config {
+	cfg := &config{
+		assetsApiHost:   os.Getenv("ASSETS_API_HOST"),
+		resizerApiHost:  os.Getenv("RESIZER_API_HOST"),
+		duplicateParams: getEnv("DUPLICATE_PARAMS", duplicateParamsFirst),
+		immutableHeader: getEnv("IMMUTABLE_HEADER", "X-Immutable"),
+		debugToken:      os.Getenv("DEBUG_TOKEN"),
+		debugErrors:     getEnvInt("DEBUG_ERRORS_SIZE", 100),
+		resizableTypes: getEnvList("RESIZABLE_TYPES", []string{
+			"image/jpeg", "image/png", "image/gif", "image/webp", "image/avif",
+			"image/heif", "image/heic", "image/jxl", "image/tiff", "image/bmp",
+			"image/x-icon", "image/svg+xml",
+		}),
+		enableTestHooks:  os.Getenv("ENABLE_TEST_HOOKS") == "true",
+		requestIDHeaders: getEnvList("REQUEST_ID_HEADERS", []string{middleware.RequestIDHeader}),
+		maxDataURLSize:   getEnvInt("MAX_DATA_URL_SIZE", 32<<10),
+		gzipLevel:        getEnvInt("GZIP_LEVEL", 6),
+		gzipMinSize:      getEnvInt("GZIP_MIN_SIZE", 1024),
+		backendHeaders: map[string]http.Header{
+			backendAssets:  getEnvHeaders("ASSETS_API_HEADERS"),
+			backendResizer: getEnvHeaders("RESIZER_API_HEADERS"),
+		},
+		maxConcurrent: getEnvInt("MAX_CONCURRENT_REQUESTS", 0),
+		queueDepth:    getEnvInt("REQUEST_QUEUE_DEPTH", 0),
+		queueTimeout:  getEnvDuration("REQUEST_QUEUE_TIMEOUT", time.Second),
+		autoQuality:   os.Getenv("AUTO_QUALITY"),
+
+		maxIdleConnsPerHost: getEnvInt("MAX_IDLE_CONNS_PER_HOST", 32),
+		canonicalHost:       os.Getenv("CANONICAL_HOST"),
+		maxResizeOptions:    getEnvInt("MAX_RESIZE_OPTIONS", 8),
+		extensionTTLs:       getEnvDurations("EXTENSION_TTLS"),
+		canonicalLinks:      getEnvBool("CANONICAL_LINKS", false),
+		http10BufferSize:    int64(getEnvInt("HTTP10_BUFFER_SIZE", 8<<20)),
+		spriteMaxIcons:      getEnvInt("SPRITE_MAX_ICONS", 50),
+		spriteMaxIconSize:   int64(getEnvInt("SPRITE_MAX_ICON_SIZE", 1<<20)),
+		spriteLayout:        getEnv("SPRITE_LAYOUT", spriteLayoutHorizontal),
+		spritePadding:       getEnvInt("SPRITE_PADDING", 0),
+
+		spriteMaxIconDimension:  getEnvInt("SPRITE_MAX_ICON_DIMENSION", 512),
+		spriteMaxSheetDimension: getEnvInt("SPRITE_MAX_SHEET_DIMENSION", 4096),
+		precompressed:           getEnvBool("PRECOMPRESSED", false),
+		bufferContentTypes:      getEnvList("BUFFER_CONTENT_TYPES", []string{"image/"}),
+		bufferMaxSize:           int64(getEnvInt("BUFFER_MAX_SIZE", 1<<20)),
+
+		allowedResizeOptions: getEnvList("RESIZE_ALLOWED_OPTIONS", nil),
+		emptyAsNoContent:     getEnvBool("EMPTY_AS_NO_CONTENT", false),
+		resizeTimeout:        getEnvDuration("RESIZE_TIMEOUT", 0),
+		resizeFallbackTTL:    getEnvDuration("RESIZE_FALLBACK_TTL", time.Minute),
+		overrideHeader:       getEnv("BACKEND_OVERRIDE_HEADER", "X-Backend-Override"),
+		overrideSecret:       os.Getenv("BACKEND_OVERRIDE_SECRET"),
+		overrideHosts:        getEnvList("BACKEND_OVERRIDE_HOSTS", nil),
+		resourcePolicy:       getEnv("CROSS_ORIGIN_RESOURCE_POLICY", "cross-origin"),
+		strictSniffing:       getEnvBool("STRICT_CONTENT_SNIFFING", false),
+		maxRequestsPerIP:     getEnvInt("MAX_REQUESTS_PER_IP", 0),
+		trustedProxies:       getEnvPrefixes("TRUSTED_PROXIES"),
+		maxConnsPerIP:        getEnvInt("MAX_CONNECTIONS_PER_IP", 0),
+		fallbackHosts:        getEnvList("ASSETS_FALLBACK_HOSTS", nil),
+		fallbackPrefixes:     getEnvList("ASSETS_FALLBACK_PREFIXES", nil),
+		resizedHeader:        os.Getenv("RESIZED_HEADER"),
+
+		maintenanceFile:       os.Getenv("MAINTENANCE_FILE"),
+		maintenanceMessage:    getEnv("MAINTENANCE_MESSAGE", "service is under maintenance"),
+		maintenanceRetryAfter: getEnvDuration("MAINTENANCE_RETRY_AFTER", 5*time.Minute),
+
+		resizePresets:  getEnvPresets("RESIZE_PRESETS"),
+		localAssetsDir: os.Getenv("LOCAL_ASSETS_DIR"),
+		requestBudget:  getEnvDuration("REQUEST_BUDGET", 0),
+
+		resizeMinSourceSize: int64(getEnvInt("RESIZE_MIN_SOURCE_SIZE", 0)),
+
+		nelReportURL: getEnv("NEL_REPORT_URL", ""),
+		nelMaxAge:    getEnvDuration("NEL_MAX_AGE", 24*time.Hour),
+
+		variantNameFormat: getEnv("VARIANT_NAME_FORMAT", "{name}-{width}{ext}"),
+
+		lastModifiedHeader: getEnv("LAST_MODIFIED_HEADER", ""),
+
+		logDenied: getEnvBool("DENY_PATHS_DEBUG", false),
+
+		compressTypes: getEnvList("COMPRESS_TYPES", nil),
+
+		getBody:        getEnv("GET_BODY", getBodyIgnore),
+		getBodyMaxSize: int64(getEnvInt("GET_BODY_MAX_SIZE", 64<<10)),
+
+		transformers:     getEnvList("TRANSFORMERS", nil),
+		transformMaxSize: int64(getEnvInt("TRANSFORM_MAX_SIZE", 1<<20)),
+
+		serverTiming: getEnvBool("SERVER_TIMING", false),
+
+		hotlinkAllowedHosts: getEnvList("HOTLINK_ALLOWED_HOSTS", nil),
+		hotlinkAllowEmpty:   getEnvBool("HOTLINK_ALLOW_EMPTY", true),
+
+		caseInsensitiveParams: getEnvBool("CASE_INSENSITIVE_PARAMS", false),
+
+		generateETags: getEnvBool("GENERATE_ETAGS", false),
+
+		maxFetchesPerHost: getEnvInt("MAX_FETCHES_PER_HOST", 0),
+		fetchQueueTimeout: getEnvDuration("FETCH_QUEUE_TIMEOUT", time.Second),
+
+		shieldURL:    getEnv("SHIELD_URL", ""),
+		shieldHeader: getEnv("SHIELD_HEADER", "X-Shield-Hop"),
+
+		blurhashCacheSize: getEnvInt("BLURHASH_CACHE_SIZE", 1024),
+
+		maxHeaderBytes: getEnvInt("MAX_HEADER_BYTES", 64<<10),
+		maxBodySize:    int64(getEnvInt("MAX_BODY_SIZE", 1<<20)),
+
+		permissionsPolicy: getEnv("PERMISSIONS_POLICY", "camera=(), microphone=(), geolocation=(), payment=(), usb=()"),
+		frameOptions:      getEnv("FRAME_OPTIONS", "DENY"),
+		referrerPolicy:    getEnv("REFERRER_POLICY", "no-referrer"),
+
+		noSniff: getEnvBool("NOSNIFF", true),
+
+		normalizeOrientation: getEnvBool("NORMALIZE_ORIENTATION", false),
+
+		contentTypes: getEnvContentTypes("CONTENT_TYPES"),
+
+		trackingParams: getEnvList("TRACKING_PARAMS", []string{"utm_*", "fbclid", "gclid", "dclid", "msclkid", "mc_eid", "_ga"}),
+	}
+
+	// Validate required environment variables
+	if cfg.assetsApiHost == "" {
+		log.Fatal("ASSETS_API_HOST environment variable is required")
+	}
+
+	if cfg.resizerApiHost == "" {
+		log.Fatal("RESIZER_API_HOST environment variable is required")
+	}
+
+	if cfg.duplicateParams != duplicateParamsFirst && cfg.duplicateParams != duplicateParamsReject {
+		log.Fatalf("DUPLICATE_PARAMS must be %q or %q", duplicateParamsFirst, duplicateParamsReject)
+	}
+
+	if cfg.gzipLevel < gzip.HuffmanOnly || cfg.gzipLevel > gzip.BestCompression {
+		log.Fatalf("GZIP_LEVEL must be between %d and %d", gzip.HuffmanOnly, gzip.BestCompression)
+	}
+
+	if cfg.spriteLayout != spriteLayoutHorizontal && cfg.spriteLayout != spriteLayoutGrid {
+		log.Fatalf("SPRITE_LAYOUT must be %q or %q", spriteLayoutHorizontal, spriteLayoutGrid)
+	}
+
+	if cfg.spritePadding < 0 || cfg.spritePadding > maxSpritePadding {
+		log.Fatalf("SPRITE_PADDING must be between 0 and %d", maxSpritePadding)
+	}
+
+	switch cfg.resourcePolicy {
+	case "same-origin", "same-site", "cross-origin":
+	default:
+		log.Fatal("CROSS_ORIGIN_RESOURCE_POLICY must be same-origin, same-site or cross-origin")
+	}
+
+	if cfg.nelReportURL != "" && !strings.HasPrefix(cfg.nelReportURL, "https://") {
+		log.Fatal("NEL_REPORT_URL must be an https URL")
+	}
+
+	for _, item := range getEnvList("VARIANT_WIDTHS", nil) {
+		width, err := strconv.Atoi(item)
+		if err != nil || width <= 0 {
+			log.Fatalf("VARIANT_WIDTHS: invalid width %q", item)
+		}
+		cfg.variantWidths = append(cfg.variantWidths, width)
+	}
+	if !strings.Contains(cfg.variantNameFormat, "{width}") {
+		log.Fatal("VARIANT_NAME_FORMAT must contain {width}")
+	}
+
+	if value := getEnv("LAST_MODIFIED_EPOCH", ""); value != "" {
+		epoch, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			log.Fatalf("LAST_MODIFIED_EPOCH must be an RFC 3339 time: %s", err)
+		}
+		cfg.lastModifiedEpoch = epoch
+	}
+
+	if value := getEnv("DENY_PATHS", ""); value != "" {
+		pattern, err := regexp.Compile(value)
+		if err != nil {
+			log.Fatalf("DENY_PATHS must be a regular expression: %s", err)
+		}
+		cfg.denyPaths = pattern
+	}
+
+	switch cfg.getBody {
+	case getBodyIgnore, getBodyDrain, getBodyReject:
+	default:
+		log.Fatalf("GET_BODY must be %q, %q or %q", getBodyIgnore, getBodyDrain, getBodyReject)
+	}
+
+	for _, name := range cfg.transformers {
+		if _, ok := transformers[name]; !ok {
+			log.Fatalf("TRANSFORMERS: unknown transformer %q", name)
+		}
+	}
+
+	for _, prefix := range getEnvList("NO_STORE_PREFIXES", nil) {
+		prefix = strings.TrimPrefix(strings.TrimPrefix(prefix, "/"), "assets/")
+		cfg.noStorePrefixes = append(cfg.noStorePrefixes, prefix)
+	}
+
+	if cfg.shieldURL != "" && !isValidURL(cfg.shieldURL) {
+		log.Fatal("SHIELD_URL must be an absolute URL")
+	}
+
+	for i, name := range cfg.trackingParams {
+		cfg.trackingParams[i] = strings.ToLower(name)
+	}
+
+	for _, value := range []*string{&cfg.permissionsPolicy, &cfg.frameOptions, &cfg.referrerPolicy} {
+		if *value == "none" {
+			*value = ""
+		}
+	}
+
+	cfg.clientCerts = map[string]*tls.Certificate{}
+	for backend, prefix := range map[string]string{backendAssets: "ASSETS_API", backendResizer: "RESIZER_API"} {
+		if cert := loadClientCert(prefix); cert != nil {
+			cfg.clientCerts[backend] = cert
+		}
+	}
+
+	return cfg
+}
+
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+func getEnvInt(key string, fallback int) int {
+	value := getEnv(key, "")
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("%s must be an integer: %s", key, err)
+	}
+	return n
+}
+
+// getEnvList reads a comma-separated list, trimming blanks around entries.
+func getEnvList(key string, fallback []string) []string {
+	value := getEnv(key, "")
+	if value == "" {
+		return fallback
+	}
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// getEnvHeaders reads a semicolon-separated list of "Name: value" pairs.
+func getEnvHeaders(key string) http.Header {
+	h := http.Header{}
+	for _, pair := range strings.Split(os.Getenv(key), ";") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			log.Fatalf("%s: invalid header %q, expected \"Name: value\"", key, pair)
+		}
+		h.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	return h
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := getEnv(key, "")
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("%s must be a duration: %s", key, err)
+	}
+	return d
+}
+
+// getEnvContentTypes reads a comma-separated list of "ext=type" pairs such
+// as "heic=image/heic,map=application/json".
+func getEnvContentTypes(key string) map[string]string {
+	types := map[string]string{}
+	for _, pair := range getEnvList(key, nil) {
+		ext, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			log.Fatalf("%s: invalid entry %q, expected ext=type", key, pair)
+		}
+		value = strings.TrimSpace(value)
+		if _, _, err := mime.ParseMediaType(value); err != nil {
+			log.Fatalf("%s: invalid content type for %q", key, ext)
+		}
+		types["."+strings.TrimPrefix(strings.ToLower(strings.TrimSpace(ext)), ".")] = value
+	}
+	return types
+}
+
+// getEnvDurations reads a comma-separated list of "ext=duration" pairs such
+// as "json=1m,woff2=8760h".
+func getEnvDurations(key string) map[string]time.Duration {
+	durations := map[string]time.Duration{}
+	for _, pair := range getEnvList(key, nil) {
+		ext, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			log.Fatalf("%s: invalid entry %q, expected ext=duration", key, pair)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || d < 0 {
+			log.Fatalf("%s: invalid duration for %q", key, ext)
+		}
+		durations["."+strings.TrimPrefix(strings.ToLower(strings.TrimSpace(ext)), ".")] = d
+	}
+	return durations
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	value := getEnv(key, "")
+	if value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("%s must be a boolean: %s", key, err)
+	}
+	return b
+}
+
+// getEnvPrefixes reads a comma-separated list of CIDR prefixes or single
+// addresses.
+func getEnvPrefixes(key string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, item := range getEnvList(key, nil) {
+		if !strings.Contains(item, "/") {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				log.Fatalf("%s: invalid address %q", key, item)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			log.Fatalf("%s: invalid prefix %q", key, item)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}
+
+// getEnvPresets reads semicolon-separated "name=query" pairs, where query is
+// a URL query string such as "type=image&w=200".
+func getEnvPresets(key string) map[string]url.Values {
+	presets := map[string]url.Values{}
+	for _, entry := range strings.Split(os.Getenv(key), ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		name, query, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		values, err := url.ParseQuery(query)
+		if !ok || name == "" || err != nil {
+			log.Fatalf("%s: invalid preset %q, expected name=query", key, entry)
+		}
+		for param, list := range values {
+			if len(list) > 1 {
+				log.Fatalf("%s: preset %q repeats %s", key, name, param)
+			}
+		}
+		presets[name] = values
+	}
+	return presets
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	errDataURLTooLarge = errors.New("data URL exceeds size limit")
+	errDataURLType     = errors.New("data URLs must contain a raster image")
+)
+
+func isDataURL(urlPath string) bool {
+	return strings.HasPrefix(urlPath, "data:")
+}
+
+// dataURLResponse decodes an RFC 2397 data URL into a synthetic backend
+// response so it can be served like any fetched asset. Payloads larger than
+// maxSize bytes are rejected before decoding. The caller picks the media
+// type, so only raster image types from allowedTypes are accepted: serving
+// HTML or SVG written into the URL from this origin would be reflected XSS.
+func dataURLResponse(urlPath string, maxSize int, allowedTypes []string) (*http.Response, error) {
+	header, payload, ok := strings.Cut(strings.TrimPrefix(urlPath, "data:"), ",")
+	if !ok {
+		return nil, errors.New("malformed data URL")
+	}
+
+	mediaType, isBase64 := strings.CutSuffix(header, ";base64")
+	base, _, err := mime.ParseMediaType(mediaType)
+	if err != nil {
+		return nil, errDataURLType
+	}
+	if !strings.HasPrefix(base, "image/") || base == "image/svg+xml" || !slices.Contains(allowedTypes, base) {
+		return nil, errDataURLType
+	}
+
+	var data []byte
+	if isBase64 {
+		if base64.StdEncoding.DecodedLen(len(payload)) > maxSize+2 {
+			return nil, errDataURLTooLarge
+		}
+		// The path has been query-unescaped, which turns a literal '+'
+		// into a space.
+		payload = strings.ReplaceAll(payload, " ", "+")
+		decoded, err := base64.StdEncoding.DecodeString(payload)
+		if err != nil {
+			return nil, errors.New("invalid base64 in data URL")
+		}
+		data = decoded
+	} else {
+		data = []byte(payload)
+	}
+	if len(data) > maxSize {
+		return nil, errDataURLTooLarge
+	}
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Content-Type":   {mediaType},
+			"Content-Length": {strconv.Itoa(len(data))},
+		},
+		ContentLength: int64(len(data)),
+		Body:          io.NopCloser(bytes.NewReader(data)),
+	}, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestDataURL(t *testing.T) {
+	pixel := []byte("\x89PNG\r\n\x1a\n+/+/")
+	encoded := base64.StdEncoding.EncodeToString(pixel)
+	tests := []struct {
+		name     string
+		env      map[string]string
+		dataURL  string
+		want     int
+		wantType string
+		wantBody string
+	}{
+		{"base64 png", nil, "data:image/png;base64," + encoded, http.StatusOK, "image/png", string(pixel)},
+		{"plain gif", nil, "data:image/gif,GIF89a", http.StatusOK, "image/gif", "GIF89a"},
+		{"html", nil, "data:text/html,<script>alert(1)</script>", http.StatusUnsupportedMediaType, "", ""},
+		{"svg", nil, "data:image/svg+xml,<svg onload=alert(1)>", http.StatusUnsupportedMediaType, "", ""},
+		{"text", nil, "data:text/plain;base64,aGk=", http.StatusUnsupportedMediaType, "", ""},
+		{"missing type", nil, "data:,hello", http.StatusUnsupportedMediaType, "", ""},
+		{"not resizable", map[string]string{"RESIZABLE_TYPES": "image/jpeg"}, "data:image/png;base64," + encoded, http.StatusUnsupportedMediaType, "", ""},
+		{"too large", map[string]string{"MAX_DATA_URL_SIZE": "4"}, "data:image/png;base64," + encoded, http.StatusRequestEntityTooLarge, "", ""},
+		{"too large plain", map[string]string{"MAX_DATA_URL_SIZE": "4"}, "data:image/gif,GIF89a", http.StatusRequestEntityTooLarge, "", ""},
+		{"malformed", nil, "data:image/png;base64", http.StatusBadRequest, "", ""},
+		{"invalid base64", nil, "data:image/png;base64,!!!", http.StatusBadRequest, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				t.Errorf("backend called for %s", r.URL)
+			})
+			cfg := testConfig(t, backend.URL, tt.env)
+
+			rec := serve(cfg, nil, httptest.NewRequest(http.MethodGet, "/assets/"+url.QueryEscape(tt.dataURL), nil))
+
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+			if got := rec.Header().Get("Content-Type"); got != tt.wantType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantType)
+			}
+			if got := rec.Header().Get("Cache-Control"); got != cacheNoStore {
+				t.Errorf("Cache-Control = %q, want %q", got, cacheNoStore)
+			}
+			if rec.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
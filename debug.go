@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxDebugErrors = 1000
+
+// sensitiveParams are query parameter name fragments whose values are
+// redacted before an upstream URL is recorded.
+var sensitiveParams = []string{"token", "key", "sig", "secret", "password", "auth"}
+
+type errorEvent struct {
+	Timestamp   time.Time `json:"timestamp"`
+	Path        string    `json:"path"`
+	UpstreamURL string    `json:"upstream_url,omitempty"`
+	Error       string    `json:"error"`
+	Status      int       `json:"status"`
+}
+
+// errorLog is a fixed-size ring buffer of the most recent error events.
+// A nil *errorLog discards everything, so callers need not check whether
+// debug mode is enabled.
+type errorLog struct {
+	mu     sync.Mutex
+	events []errorEvent
+	next   int
+	full   bool
+}
+
+func newErrorLog(size int) *errorLog {
+	if size > maxDebugErrors {
+		size = maxDebugErrors
+	}
+	if size <= 0 {
+		return nil
+	}
+	return &errorLog{events: make([]errorEvent, size)}
+}
+
+func (l *errorLog) record(r *http.Request, status int, upstreamURL string, err error) {
+	if l == nil {
+		return
+	}
+	event := errorEvent{
+		Timestamp:   time.Now().UTC(),
+		Path:        r.URL.Path,
+		UpstreamURL: redactURL(upstreamURL),
+		Error:       redactError(err),
+		Status:      status,
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events[l.next] = event
+	l.next = (l.next + 1) % len(l.events)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// list returns the recorded events, oldest first.
+func (l *errorLog) list() []errorEvent {
+	if l == nil {
+		return []errorEvent{}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.full {
+		return append([]errorEvent{}, l.events[:l.next]...)
+	}
+	return append(append([]errorEvent{}, l.events[l.next:]...), l.events[:l.next]...)
+}
+
+func redactURL(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "[unparseable url]"
+	}
+	q := u.Query()
+	for name := range q {
+		lower := strings.ToLower(name)
+		for _, s := range sensitiveParams {
+			if strings.Contains(lower, s) {
+				q.Set(name, "REDACTED")
+				break
+			}
+		}
+	}
+	u.RawQuery = q.Encode()
+	// Resizer URLs carry the source URL, query and all, in their path.
+	if prefix, source, ok := strings.Cut(u.Path, "/plain/"); ok && isValidURL(source) {
+		u.Path = prefix + "/plain/" + redactURL(source)
+		u.RawPath = ""
+	}
+	return u.Redacted()
+}
+
+// redactError returns the text of err with any request URL it mentions
+// redacted. Transport failures are *url.Error values that quote the full
+// upstream URL.
+func redactError(err error) string {
+	msg := err.Error()
+	var ue *url.Error
+	if errors.As(err, &ue) && ue.URL != "" {
+		msg = strings.ReplaceAll(msg, ue.URL, redactURL(ue.URL))
+	}
+	return msg
+}
+
+// requireToken rejects requests that do not carry the bearer token.
+func requireToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			writeError(w, r, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func debugErrorsHandler(errs *errorLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(map[string][]errorEvent{"errors": errs.list()})
+	}
+}
+
+// flushCacheHandler empties the proxy's in-memory caches and reports how
+// many entries were dropped. The BlurHash cache is swapped for a fresh one,
+// so requests in flight finish against the old cache without blocking and
+// it is garbage collected once they are done. Responses themselves are not
+// cached here; downstream caches have to be purged separately.
+func flushCacheHandler(w http.ResponseWriter, r *http.Request) {
+	old := blurhashes.Swap(newBlurhashCache(blurhashes.Load().size))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]int{"cleared": old.len()})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// resizedETag derives a validator for resizer output from the resizer URL,
+// which already encodes the source URL and every processing option, and
+// from the source's own validator, so replacing the source at the same path
+// changes the ETag. The same request therefore yields the same ETag without
+// contacting the resizer. It is weak because the resizer does not promise
+// byte-identical output across versions.
+func resizedETag(resizerURL, sourceValidator string) string {
+	sum := sha256.Sum256([]byte(resizerURL + "\n" + sourceValidator))
+	return `W/"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// assetETag generates a validator for a backend response that came without
+// one. A body held in memory gets a strong ETag from its hash; a streamed
+// body gets a weak one from its URL, length, which is -1 when unknown, and
+// modification time, or none when the modification time is not known.
+func assetETag(resp *http.Response, buffered bool, upstreamURL string, modified time.Time) string {
+	if buffered {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return ""
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+		return `"` + hex.EncodeToString(sum[:16]) + `"`
+	}
+	if modified.IsZero() {
+		return ""
+	}
+	sum := sha256.Sum256(fmt.Appendf(nil, "%s\n%d\n%d", upstreamURL, resp.ContentLength, modified.Unix()))
+	return `W/"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches reports whether an If-None-Match header matches etag using
+// the weak comparison required for GET.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" || etag == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeNotModified answers a conditional request whose validator matched.
+func writeNotModified(w http.ResponseWriter, etag, cacheControl string) {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", cacheControl)
+	w.WriteHeader(http.StatusNotModified)
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEtagMatches(t *testing.T) {
+	tests := []struct {
+		ifNoneMatch string
+		etag        string
+		want        bool
+	}{
+		{"", `"a"`, false},
+		{`"a"`, "", false},
+		{`"a"`, `"a"`, true},
+		{`W/"a"`, `"a"`, true},
+		{`"a"`, `W/"a"`, true},
+		{`"b", "a"`, `"a"`, true},
+		{`"b"`, `"a"`, false},
+		{"*", `"a"`, true},
+	}
+	for _, tt := range tests {
+		if got := etagMatches(tt.ifNoneMatch, tt.etag); got != tt.want {
+			t.Errorf("etagMatches(%q, %q) = %v, want %v", tt.ifNoneMatch, tt.etag, got, tt.want)
+		}
+	}
+}
+
+func TestResizedETag(t *testing.T) {
+	// sourceETag is what the backend reports for the source on HEAD.
+	sourceETag := `"v1"`
+	var resizerCalls int
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/insecure/") {
+			resizerCalls++
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("resized"))
+			return
+		}
+		if sourceETag != "" {
+			w.Header().Set("ETag", sourceETag)
+		}
+		w.Write([]byte("original"))
+	})
+	// A minimum source size has every resize look the source up.
+	cfg := testConfig(t, backend.URL, map[string]string{"RESIZE_MIN_SOURCE_SIZE": "1"})
+	get := func(query, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/assets/a.png?"+query, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		return serve(cfg, nil, req)
+	}
+
+	first := get("type=image&w=100", "")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || !strings.HasPrefix(etag, `W/"`) {
+		t.Fatalf("status = %d, ETag = %q, want 200 with a weak ETag", first.Code, etag)
+	}
+
+	tests := []struct {
+		name        string
+		sourceETag  string
+		query       string
+		ifNoneMatch string
+		wantStatus  int
+		wantETag    string // "same", "other" or "none"
+	}{
+		{"repeat", `"v1"`, "type=image&w=100", "", http.StatusOK, "same"},
+		{"conditional", `"v1"`, "type=image&w=100", etag, http.StatusNotModified, "same"},
+		{"other options", `"v1"`, "type=image&w=200", etag, http.StatusOK, "other"},
+		{"source replaced", `"v2"`, "type=image&w=100", etag, http.StatusOK, "other"},
+		{"no source validator", "", "type=image&w=100", etag, http.StatusOK, "none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sourceETag = tt.sourceETag
+			resizerCalls = 0
+			rec := get(tt.query, tt.ifNoneMatch)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			got := rec.Header().Get("ETag")
+			switch {
+			case tt.wantETag == "same" && got != etag:
+				t.Errorf("ETag = %q, want %q", got, etag)
+			case tt.wantETag == "other" && (got == "" || got == etag):
+				t.Errorf("ETag = %q, want a new one", got)
+			case tt.wantETag == "none" && got != "":
+				t.Errorf("ETag = %q, want none", got)
+			}
+			if tt.wantStatus == http.StatusNotModified && resizerCalls != 0 {
+				t.Errorf("resizer called %d times for a 304", resizerCalls)
+			}
+		})
+	}
+}
+
+func TestResizedETagSource(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         map[string]string
+		resizerETag string
+		ifNoneMatch string // "first" sends the ETag of a first response
+		wantStatus  int
+		wantHeads   int
+		wantETag    bool
+	}{
+		{"no validators", nil, "", "", http.StatusOK, 0, false},
+		{"resizer validator", nil, `"r1"`, "", http.StatusOK, 0, true},
+		{"resizer validator revalidated", nil, `"r1"`, "first", http.StatusNotModified, 1, true},
+		{"revalidation", nil, "", `W/"stale"`, http.StatusOK, 1, true},
+		{"min source size", map[string]string{"RESIZE_MIN_SOURCE_SIZE": "1"}, "", "", http.StatusOK, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var heads int
+			backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasPrefix(r.URL.Path, "/insecure/") {
+					if tt.resizerETag != "" {
+						w.Header().Set("ETag", tt.resizerETag)
+					}
+					w.Header().Set("Content-Type", "image/png")
+					w.Write([]byte("resized"))
+					return
+				}
+				if r.Method == http.MethodHead {
+					heads++
+				}
+				w.Header().Set("ETag", `"v1"`)
+				w.Write([]byte("original"))
+			})
+			cfg := testConfig(t, backend.URL, tt.env)
+			get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest(http.MethodGet, "/assets/a.png?type=image&w=100", nil)
+				if ifNoneMatch != "" {
+					req.Header.Set("If-None-Match", ifNoneMatch)
+				}
+				return serve(cfg, nil, req)
+			}
+
+			rec := get("")
+			if tt.ifNoneMatch != "" {
+				ifNoneMatch := tt.ifNoneMatch
+				if ifNoneMatch == "first" {
+					ifNoneMatch = rec.Header().Get("ETag")
+				}
+				heads = 0
+				rec = get(ifNoneMatch)
+			}
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if heads != tt.wantHeads {
+				t.Errorf("source HEAD requests = %d, want %d", heads, tt.wantHeads)
+			}
+			if etag := rec.Header().Get("ETag"); (etag != "") != tt.wantETag {
+				t.Errorf("ETag = %q, want one: %v", etag, tt.wantETag)
+			}
+		})
+	}
+}
+
+func TestAssetETag(t *testing.T) {
+	modified := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	tests := []struct {
+		name     string
+		body     string
+		length   int64
+		buffered bool
+		url      string
+		modified time.Time
+		want     string // "strong", "weak" or ""
+	}{
+		{"buffered", "hello", 5, true, "http://assets/a.png", time.Time{}, "strong"},
+		{"streamed", "hello", 5, false, "http://assets/a.txt", modified, "weak"},
+		{"streamed unknown length", "hello", -1, false, "http://assets/a.txt", modified, "weak"},
+		{"streamed unknown modification", "hello", 5, false, "http://assets/a.txt", time.Time{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{ContentLength: tt.length, Body: io.NopCloser(strings.NewReader(tt.body))}
+			got := assetETag(resp, tt.buffered, tt.url, tt.modified)
+			switch tt.want {
+			case "":
+				if got != "" {
+					t.Errorf("assetETag() = %q, want none", got)
+				}
+			case "strong":
+				if !strings.HasPrefix(got, `"`) {
+					t.Errorf("assetETag() = %q, want a strong ETag", got)
+				}
+			case "weak":
+				if !strings.HasPrefix(got, `W/"`) {
+					t.Errorf("assetETag() = %q, want a weak ETag", got)
+				}
+			}
+			if data, _ := io.ReadAll(resp.Body); string(data) != tt.body {
+				t.Errorf("body = %q after hashing, want %q", data, tt.body)
+			}
+		})
+	}
+
+	hash := func(body string, buffered bool, url string, modified time.Time) string {
+		resp := &http.Response{ContentLength: int64(len(body)), Body: io.NopCloser(strings.NewReader(body))}
+		return assetETag(resp, buffered, url, modified)
+	}
+	if hash("a", true, "u1", modified) != hash("a", true, "u2", time.Time{}) {
+		t.Error("buffered ETag depends on more than the body")
+	}
+	if hash("a", true, "u", modified) == hash("b", true, "u", modified) {
+		t.Error("buffered ETag does not change with the body")
+	}
+	streamed := func(length int64) string {
+		return assetETag(&http.Response{ContentLength: length, Body: http.NoBody}, false, "u", modified)
+	}
+	if streamed(-1) == streamed(1) {
+		t.Error("streamed ETag of unknown length matches a known one")
+	}
+	if hash("a", false, "u", modified) == hash("a", false, "u", modified.Add(time.Second)) {
+		t.Error("streamed ETag does not change with the modification time")
+	}
+}
+
+func TestGeneratedETags(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         map[string]string
+		path        string
+		header      map[string]string
+		chunked     bool
+		ifNoneMatch bool
+		want        string // "strong", "weak", "backend" or ""
+		wantStatus  int
+	}{
+		{"buffered image", map[string]string{"GENERATE_ETAGS": "true"}, "a.png", nil, false, false, "strong", http.StatusOK},
+		{"streamed with date", map[string]string{"GENERATE_ETAGS": "true"}, "a.txt", map[string]string{"Last-Modified": "Mon, 06 May 2024 07:08:09 GMT"}, false, false, "weak", http.StatusOK},
+		{"streamed without date", map[string]string{"GENERATE_ETAGS": "true"}, "a.txt", nil, false, false, "", http.StatusOK},
+		{"backend etag wins", map[string]string{"GENERATE_ETAGS": "true"}, "a.png", map[string]string{"ETag": `"backend"`}, false, false, "backend", http.StatusOK},
+		{"backend etag revalidated", map[string]string{"GENERATE_ETAGS": "true"}, "a.png", map[string]string{"ETag": `"backend"`}, false, true, "backend", http.StatusNotModified},
+		{"revalidated", map[string]string{"GENERATE_ETAGS": "true"}, "a.png", nil, false, true, "strong", http.StatusNotModified},
+		{"resized revalidated", map[string]string{"GENERATE_ETAGS": "true"}, "a.png?type=image&w=10", nil, false, true, "strong", http.StatusNotModified},
+		{"chunked image", map[string]string{"GENERATE_ETAGS": "true"}, "a.png", nil, true, false, "strong", http.StatusOK},
+		{"chunked text", map[string]string{"GENERATE_ETAGS": "true"}, "a.txt", nil, true, false, "strong", http.StatusOK},
+		{"chunked over buffer size", map[string]string{"GENERATE_ETAGS": "true", "BUFFER_MAX_SIZE": "4"}, "a.txt", map[string]string{"Last-Modified": "Mon, 06 May 2024 07:08:09 GMT"}, true, false, "weak", http.StatusOK},
+		{"disabled", nil, "a.png", nil, false, false, "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				for name, value := range tt.header {
+					w.Header().Set(name, value)
+				}
+				w.Header().Set("Content-Type", getContentTypeFromFilename(r.URL.Path))
+				w.Write([]byte("con"))
+				if tt.chunked {
+					w.(http.Flusher).Flush()
+				}
+				w.Write([]byte("tent"))
+			})
+			cfg := testConfig(t, backend.URL, tt.env)
+			first := serve(cfg, nil, httptest.NewRequest(http.MethodGet, "/assets/"+tt.path, nil))
+			etag := first.Header().Get("ETag")
+
+			rec := first
+			if tt.ifNoneMatch {
+				req := httptest.NewRequest(http.MethodGet, "/assets/"+tt.path, nil)
+				req.Header.Set("If-None-Match", etag)
+				rec = serve(cfg, nil, req)
+			}
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			switch tt.want {
+			case "":
+				if etag != "" {
+					t.Errorf("ETag = %q, want none", etag)
+				}
+			case "strong":
+				if !strings.HasPrefix(etag, `"`) {
+					t.Errorf("ETag = %q, want a strong ETag", etag)
+				}
+			case "weak":
+				if !strings.HasPrefix(etag, `W/"`) {
+					t.Errorf("ETag = %q, want a weak ETag", etag)
+				}
+			case "backend":
+				if etag != `"backend"` {
+					t.Errorf("ETag = %q, want the backend's", etag)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+)
+
+// fallbackHosts returns the backup asset backends to try, in order, when
+// the primary fails for urlPath. Absolute source URLs have no fallback, and
+// when ASSETS_FALLBACK_PREFIXES is set only matching paths fall back.
+func fallbackHosts(cfg *config, urlPath string) []string {
+	if isValidURL(urlPath) || len(cfg.fallbackHosts) == 0 {
+		return nil
+	}
+	if len(cfg.fallbackPrefixes) == 0 {
+		return cfg.fallbackHosts
+	}
+	for _, prefix := range cfg.fallbackPrefixes {
+		if strings.HasPrefix(urlPath, strings.TrimPrefix(prefix, "/")) {
+			return cfg.fallbackHosts
+		}
+	}
+	return nil
+}
+
+// shouldFallBack reports whether a failed fetch may succeed on another
+// backend: the asset was missing, the backend failed, or it was unreachable.
+func shouldFallBack(err error) bool {
+	se, ok := err.(*statusError)
+	return !ok || se.code == http.StatusNotFound || se.code >= 500
+}
+
+// fetchFallback retries a failed fetch against each fallback backend in
+// turn and, on success, rewrites t to describe the backend that answered.
+// It returns the last error when every backend failed.
+func fetchFallback(r *http.Request, cfg *config, urlPath string, t *target, err error) (*http.Response, error) {
+	for _, host := range fallbackHosts(cfg, urlPath) {
+		if !shouldFallBack(err) {
+			break
+		}
+		next, buildErr := buildFullURL(r, cfg, urlPath, host)
+		if buildErr != nil {
+			return nil, err
+		}
+		var resp *http.Response
+		resp, err = fetchAsset(r.Context(), next.url, next.backend, upstreamHeaders(r, cfg, next))
+		if err == nil {
+			next.vary = t.vary
+			*t = next
+			return resp, nil
+		}
+	}
+	return nil, err
+}
+
+// serveLocal serves urlPath from LOCAL_ASSETS_DIR as the last fallback for
+// asset backend requests, mainly for development. http.ServeContent takes
+// care of Range and conditional requests. It reports whether the file
+// existed and was served.
+func serveLocal(w http.ResponseWriter, r *http.Request, cfg *config, urlPath, mediaType, cacheControl string) bool {
+	root, err := os.OpenRoot(cfg.localAssetsDir)
+	if err != nil {
+		return false
+	}
+	defer root.Close()
+	f, err := root.Open(urlPath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		return false
+	}
+
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Cache-Control", cacheControl)
+	setCrossOriginHeaders(w.Header(), cfg)
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+	return true
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// statusBackend answers every request with status, and with name as the
+// body on success, recording the Authorization it received.
+func statusBackend(t *testing.T, name string, status *int, authorization *string) *httptest.Server {
+	return newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		*authorization = r.Header.Get("Authorization")
+		w.WriteHeader(*status)
+		w.Write([]byte(name))
+	})
+}
+
+func TestFallbackHosts(t *testing.T) {
+	var primaryStatus, firstStatus, secondStatus int
+	var primaryAuth, firstAuth, secondAuth string
+	primary := statusBackend(t, "primary", &primaryStatus, &primaryAuth)
+	first := statusBackend(t, "first", &firstStatus, &firstAuth)
+	second := statusBackend(t, "second", &secondStatus, &secondAuth)
+	env := map[string]string{
+		"ASSETS_FALLBACK_HOSTS": first.URL + "," + second.URL,
+		"ASSETS_API_HEADERS":    "Authorization: Bearer primary",
+	}
+
+	tests := []struct {
+		name                   string
+		env                    map[string]string
+		path                   string
+		primary, first, second int
+		wantStatus             int
+		wantBody               string
+	}{
+		{"primary ok", env, "a.txt", 200, 200, 200, http.StatusOK, "primary"},
+		{"missing", env, "a.txt", 404, 200, 200, http.StatusOK, "first"},
+		{"server error", env, "a.txt", 503, 200, 200, http.StatusOK, "first"},
+		{"second fallback", env, "a.txt", 404, 500, 200, http.StatusOK, "second"},
+		{"all fail", env, "a.txt", 404, 404, 502, http.StatusInternalServerError, ""},
+		{"forbidden does not fall back", env, "a.txt", 403, 200, 200, http.StatusInternalServerError, ""},
+		{"fallback stops on client error", env, "a.txt", 404, 403, 200, http.StatusInternalServerError, ""},
+		{"matching prefix", map[string]string{"ASSETS_FALLBACK_HOSTS": first.URL, "ASSETS_FALLBACK_PREFIXES": "/static/"}, "static/a.txt", 404, 200, 200, http.StatusOK, "first"},
+		{"other prefix", map[string]string{"ASSETS_FALLBACK_HOSTS": first.URL, "ASSETS_FALLBACK_PREFIXES": "static/"}, "media/a.txt", 404, 200, 200, http.StatusInternalServerError, ""},
+		{"absolute url", env, url.QueryEscape(primary.URL + "/a.txt"), 404, 200, 200, http.StatusInternalServerError, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primaryStatus, firstStatus, secondStatus = tt.primary, tt.first, tt.second
+			firstAuth, secondAuth = "", ""
+			cfg := testConfig(t, primary.URL, tt.env)
+			rec := serve(cfg, nil, httptest.NewRequest(http.MethodGet, "/assets/"+tt.path, nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusOK && rec.Body.String() != tt.wantBody {
+				t.Errorf("served by %q, want %q", rec.Body, tt.wantBody)
+			}
+			if firstAuth != "" || secondAuth != "" {
+				t.Errorf("fallback hosts received Authorization %q, %q", firstAuth, secondAuth)
+			}
+		})
+	}
+}
+
+func TestLocalAssetsFallback(t *testing.T) {
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "assets")
+	for name, data := range map[string]string{
+		"assets/a.txt":     "local file",
+		"assets/sub/b.css": "body{}",
+		"secret.txt":       "outside the root",
+	} {
+		path := filepath.Join(parent, name)
+		os.MkdirAll(filepath.Dir(path), 0o755)
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var status int
+	var authorization string
+	backend := statusBackend(t, "backend", &status, &authorization)
+
+	tests := []struct {
+		name        string
+		status      int
+		path        string
+		rangeHeader string
+		wantStatus  int
+		wantBody    string
+	}{
+		{"backend ok", 200, "a.txt", "", http.StatusOK, "backend"},
+		{"backend missing", 404, "a.txt", "", http.StatusOK, "local file"},
+		{"backend down", 503, "sub/b.css", "", http.StatusOK, "body{}"},
+		{"range", 404, "a.txt", "bytes=0-4", http.StatusPartialContent, "local"},
+		{"missing locally", 404, "c.txt", "", http.StatusInternalServerError, ""},
+		{"directory", 404, "sub", "", http.StatusInternalServerError, ""},
+		{"escape", 404, "..%2Fsecret.txt", "", http.StatusInternalServerError, ""},
+		{"resized", 404, "a.txt?type=image", "", http.StatusInternalServerError, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status = tt.status
+			cfg := testConfig(t, backend.URL, map[string]string{"LOCAL_ASSETS_DIR": dir, "RESIZABLE_TYPES": "text/plain"})
+			req := httptest.NewRequest(http.MethodGet, "/assets/"+tt.path, nil)
+			if tt.rangeHeader != "" {
+				req.Header.Set("Range", tt.rangeHeader)
+			}
+			rec := serve(cfg, nil, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rec.Body, tt.wantBody)
+			}
+		})
+	}
+}
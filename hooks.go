@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+const maxTestDelay = 30 * time.Second
+
+// testHooks implements QA-only request parameters. It is installed only when
+// ENABLE_TEST_HOOKS=true:
+//
+//	__delay=500ms  sleep before handling the request (capped at maxTestDelay)
+func testHooks(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if value := r.URL.Query().Get("__delay"); value != "" {
+			delay, err := time.ParseDuration(value)
+			if err != nil || delay < 0 {
+				writeError(w, r, http.StatusBadRequest, "invalid __delay")
+				return
+			}
+			if delay > maxTestDelay {
+				delay = maxTestDelay
+			}
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
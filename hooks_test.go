@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDelayHook(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		want      int
+		wantDelay time.Duration
+	}{
+		{"no delay", "", http.StatusOK, 0},
+		{"delay", "__delay=50ms", http.StatusOK, 50 * time.Millisecond},
+		{"invalid", "__delay=soon", http.StatusBadRequest, 0},
+		{"negative", "__delay=-1s", http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := testHooks(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			rec := httptest.NewRecorder()
+			start := time.Now()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/assets/a.txt?"+tt.query, nil))
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if elapsed := time.Since(start); elapsed < tt.wantDelay {
+				t.Errorf("answered after %v, want at least %v", elapsed, tt.wantDelay)
+			}
+		})
+	}
+}
+
+func TestDelayHookCanceled(t *testing.T) {
+	called := false
+	handler := testHooks(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true }))
+	req := httptest.NewRequest(http.MethodGet, "/assets/a.txt?__delay=1h", nil)
+	ctx, cancel := context.WithTimeout(req.Context(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	handler.ServeHTTP(httptest.NewRecorder(), req.WithContext(ctx))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("canceled request waited %v", elapsed)
+	}
+	if called {
+		t.Error("canceled request reached the handler")
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// hotlinkAllowed reports whether an image request comes from a page we
+// serve. The Referer, or Origin when the Referer is absent, must name one of
+// HOTLINK_ALLOWED_HOSTS or a subdomain of one. Requests carrying neither
+// are allowed only with HOTLINK_ALLOW_EMPTY, since privacy settings and
+// some apps strip both.
+func hotlinkAllowed(r *http.Request, cfg *config) bool {
+	source := r.Header.Get("Referer")
+	if source == "" {
+		source = r.Header.Get("Origin")
+	}
+	if source == "" {
+		return cfg.hotlinkAllowEmpty
+	}
+	u, err := url.Parse(source)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range cfg.hotlinkAllowedHosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHotlink applies hotlink protection to an image response and answers
+// 403 when the request is not allowed. The outcome depends on the Referer
+// and Origin, so both are added to vary either way.
+func checkHotlink(w http.ResponseWriter, r *http.Request, cfg *config, vary *varySet) bool {
+	vary.add("Referer")
+	vary.add("Origin")
+	if hotlinkAllowed(r, cfg) {
+		return true
+	}
+	vary.apply(w.Header())
+	writeError(w, r, http.StatusForbidden, "hotlinking is not allowed")
+	return false
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHotlinkAllowed(t *testing.T) {
+	tests := []struct {
+		name       string
+		allowEmpty bool
+		referer    string
+		origin     string
+		want       bool
+	}{
+		{"allowed host", false, "https://example.com/page", "", true},
+		{"subdomain", false, "https://www.example.com/page", "", true},
+		{"case insensitive", false, "https://WWW.Example.COM/", "", true},
+		{"with port", false, "http://example.com:8080/", "", true},
+		{"other host", false, "https://evil.test/", "", false},
+		{"suffix without dot", false, "https://notexample.com/", "", false},
+		{"allowed as subdomain of other", false, "https://example.com.evil.test/", "", false},
+		{"origin used without referer", false, "", "https://cdn.example.com", true},
+		{"referer wins over origin", false, "https://evil.test/", "https://example.com", false},
+		{"empty allowed", true, "", "", true},
+		{"empty denied", false, "", "", false},
+		{"unparseable", true, "http://[::1", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config{hotlinkAllowedHosts: []string{"Example.com"}, hotlinkAllowEmpty: tt.allowEmpty}
+			r := httptest.NewRequest(http.MethodGet, "/assets/a.png", nil)
+			if tt.referer != "" {
+				r.Header.Set("Referer", tt.referer)
+			}
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if got := hotlinkAllowed(r, cfg); got != tt.want {
+				t.Errorf("hotlinkAllowed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHotlinkProtection(t *testing.T) {
+	files := map[string][]byte{
+		"a.png": solidPNG(t, 2, 2, red),
+		"a.css": []byte("body{}"),
+		"b.png": solidPNG(t, 2, 2, blue),
+		"photo": solidPNG(t, 2, 2, red),
+		"notes": []byte("plain notes"),
+	}
+	env := map[string]string{"HOTLINK_ALLOWED_HOSTS": "example.com", "HOTLINK_ALLOW_EMPTY": "false"}
+	tests := []struct {
+		name       string
+		env        map[string]string
+		path       string
+		referer    string
+		wantStatus int
+		wantVary   bool
+	}{
+		{"image from our page", env, "/assets/a.png", "https://example.com/", http.StatusOK, true},
+		{"image hotlinked", env, "/assets/a.png", "https://evil.test/", http.StatusForbidden, true},
+		{"image without referer", env, "/assets/a.png", "", http.StatusForbidden, true},
+		{"extension-less image from our page", env, "/assets/photo", "https://example.com/", http.StatusOK, true},
+		{"extension-less image hotlinked", env, "/assets/photo", "https://evil.test/", http.StatusForbidden, true},
+		{"extension-less text unprotected", env, "/assets/notes", "https://evil.test/", http.StatusOK, false},
+		{"stylesheet unprotected", env, "/assets/a.css", "https://evil.test/", http.StatusOK, false},
+		{"not configured", nil, "/assets/a.png", "https://evil.test/", http.StatusOK, false},
+		{"sprite from our page", env, "/sprite?icons=a.png,b.png", "https://example.com/", http.StatusOK, true},
+		{"sprite hotlinked", env, "/sprite?icons=a.png,b.png", "https://evil.test/", http.StatusForbidden, true},
+		{"sprite css unprotected", env, "/sprite?icons=a.png,b.png&format=css", "https://evil.test/", http.StatusOK, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, iconBackend(t, files).URL, tt.env)
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.referer != "" {
+				req.Header.Set("Referer", tt.referer)
+			}
+
+			rec := serve(cfg, nil, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Vary"); (got == "Referer, Origin") != tt.wantVary {
+				t.Errorf("Vary = %q, want Referer, Origin: %v", got, tt.wantVary)
+			}
+		})
+	}
+}
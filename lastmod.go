@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// lastModified returns the modification time to advertise for a backend
+// response. The backend's own Last-Modified wins; otherwise the time is read
+// from LAST_MODIFIED_HEADER (an HTTP date, RFC 3339 or Unix seconds), and
+// immutable responses fall back to the fixed LAST_MODIFIED_EPOCH. The zero
+// time means none is known.
+func lastModified(resp *http.Response, cfg *config, immutable bool) time.Time {
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		return t
+	}
+	if value := resp.Header.Get(cfg.lastModifiedHeader); cfg.lastModifiedHeader != "" && value != "" {
+		if t, err := http.ParseTime(value); err == nil {
+			return t
+		}
+		if t, err := time.Parse(time.RFC3339, value); err == nil {
+			return t
+		}
+		if seconds, err := strconv.ParseInt(value, 10, 64); err == nil && seconds > 0 {
+			return time.Unix(seconds, 0)
+		}
+	}
+	if immutable {
+		return cfg.lastModifiedEpoch
+	}
+	return time.Time{}
+}
+
+// notModifiedSince reports whether If-Modified-Since shows the client
+// already has the version last modified at modified. If-None-Match takes
+// precedence, so the header is ignored when both are sent.
+func notModifiedSince(r *http.Request, modified time.Time) bool {
+	if modified.IsZero() || r.Header.Get("If-None-Match") != "" {
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !modified.Truncate(time.Second).After(since)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLastModified(t *testing.T) {
+	epoch := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	generated := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	cfg := &config{lastModifiedHeader: "X-Generated-At", lastModifiedEpoch: epoch}
+	tests := []struct {
+		name      string
+		header    map[string]string
+		immutable bool
+		want      time.Time
+	}{
+		{"backend wins", map[string]string{"Last-Modified": "Wed, 01 Mar 2023 00:00:00 GMT", "X-Generated-At": "1700000000"}, true, time.Date(2023, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"http date", map[string]string{"X-Generated-At": generated.Format(http.TimeFormat)}, false, generated},
+		{"rfc 3339", map[string]string{"X-Generated-At": generated.Format(time.RFC3339)}, false, generated},
+		{"unix seconds", map[string]string{"X-Generated-At": "1714979289"}, false, generated},
+		{"unparseable header immutable", map[string]string{"X-Generated-At": "yesterday"}, true, epoch},
+		{"unparseable header", map[string]string{"X-Generated-At": "yesterday"}, false, time.Time{}},
+		{"zero seconds", map[string]string{"X-Generated-At": "0"}, false, time.Time{}},
+		{"invalid backend date", map[string]string{"Last-Modified": "soon"}, true, epoch},
+		{"nothing known", nil, false, time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{Header: http.Header{}}
+			for name, value := range tt.header {
+				resp.Header.Set(name, value)
+			}
+			if got := lastModified(resp, cfg, tt.immutable); !got.Equal(tt.want) {
+				t.Errorf("lastModified() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNotModifiedSince(t *testing.T) {
+	modified := time.Date(2024, 5, 6, 7, 8, 9, 500, time.UTC)
+	tests := []struct {
+		name     string
+		modified time.Time
+		header   map[string]string
+		want     bool
+	}{
+		{"same second", modified, map[string]string{"If-Modified-Since": "Mon, 06 May 2024 07:08:09 GMT"}, true},
+		{"later", modified, map[string]string{"If-Modified-Since": "Tue, 07 May 2024 00:00:00 GMT"}, true},
+		{"earlier", modified, map[string]string{"If-Modified-Since": "Sun, 05 May 2024 00:00:00 GMT"}, false},
+		{"etag takes precedence", modified, map[string]string{"If-Modified-Since": "Tue, 07 May 2024 00:00:00 GMT", "If-None-Match": `"x"`}, false},
+		{"unknown modification", time.Time{}, map[string]string{"If-Modified-Since": "Tue, 07 May 2024 00:00:00 GMT"}, false},
+		{"invalid date", modified, map[string]string{"If-Modified-Since": "later"}, false},
+		{"no header", modified, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/assets/a.txt", nil)
+			for name, value := range tt.header {
+				r.Header.Set(name, value)
+			}
+			if got := notModifiedSince(r, tt.modified); got != tt.want {
+				t.Errorf("notModifiedSince() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSynthesizedLastModified(t *testing.T) {
+	tests := []struct {
+		name         string
+		env          map[string]string
+		header       map[string]string
+		since        string
+		wantModified string
+		wantStatus   int
+	}{
+		{"from header", map[string]string{"LAST_MODIFIED_HEADER": "X-Generated-At"}, map[string]string{"X-Generated-At": "1714979289"}, "", "Mon, 06 May 2024 07:08:09 GMT", http.StatusOK},
+		{"from header revalidated", map[string]string{"LAST_MODIFIED_HEADER": "X-Generated-At"}, map[string]string{"X-Generated-At": "1714979289"}, "Mon, 06 May 2024 07:08:09 GMT", "Mon, 06 May 2024 07:08:09 GMT", http.StatusNotModified},
+		{"epoch for immutable", map[string]string{"LAST_MODIFIED_EPOCH": "2020-01-01T00:00:00Z"}, map[string]string{"Cache-Control": "public, max-age=31536000, immutable"}, "", "Wed, 01 Jan 2020 00:00:00 GMT", http.StatusOK},
+		{"no epoch for mutable", map[string]string{"LAST_MODIFIED_EPOCH": "2020-01-01T00:00:00Z"}, nil, "", "", http.StatusOK},
+		{"not configured", nil, map[string]string{"X-Generated-At": "1714979289"}, "", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				for name, value := range tt.header {
+					w.Header().Set(name, value)
+				}
+				w.Write([]byte("body"))
+			})
+			cfg := testConfig(t, backend.URL, tt.env)
+			req := httptest.NewRequest(http.MethodGet, "/assets/a.txt", nil)
+			if tt.since != "" {
+				req.Header.Set("If-Modified-Since", tt.since)
+			}
+
+			rec := serve(cfg, nil, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Last-Modified"); got != tt.wantModified {
+				t.Errorf("Last-Modified = %q, want %q", got, tt.wantModified)
+			}
+		})
+	}
+}
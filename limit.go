@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// concurrencyLimiter caps the number of requests handled at once. Requests
+// arriving while every slot is busy wait in a bounded queue for up to
+// maxWait before being turned away with 503.
+type concurrencyLimiter struct {
+	slots    chan struct{}
+	queued   atomic.Int64
+	maxQueue int64
+	maxWait  time.Duration
+}
+
+func newConcurrencyLimiter(limit, maxQueue int, maxWait time.Duration) *concurrencyLimiter {
+	return &concurrencyLimiter{
+		slots:    make(chan struct{}, limit),
+		maxQueue: int64(maxQueue),
+		maxWait:  maxWait,
+	}
+}
+
+func (l *concurrencyLimiter) acquire(r *http.Request) bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	if l.queued.Add(1) > l.maxQueue {
+		l.queued.Add(-1)
+		return false
+	}
+	defer l.queued.Add(-1)
+
+	timer := time.NewTimer(l.maxWait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+func (l *concurrencyLimiter) release() {
+	<-l.slots
+}
+
+func (l *concurrencyLimiter) middleware(next http.Handler) http.Handler {
+	retryAfter := strconv.Itoa(max(1, int(l.maxWait.Round(time.Second)/time.Second)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !l.acquire(r) {
+			w.Header().Set("Retry-After", retryAfter)
+			writeError(w, r, http.StatusServiceUnavailable, "server is busy")
+			return
+		}
+		slot := &heldSlot{limiter: l, held: true}
+		defer slot.release()
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), heldSlotKey{}, slot)))
+	})
+}
+
+// errBusy is returned when a slot a request waits for does not free up in
+// time. It is answered with 503.
+var errBusy = errors.New("no slot became free in time")
+
+type heldSlotKey struct{}
+
+// heldSlot is the concurrencyLimiter slot of one request. While the
+// request waits for a fetch slot it gives the slot up, so requests to other
+// hosts can run meanwhile, and takes it back before fetching. When several
+// of its fetches wait at once, the slot is taken back by the last of them.
+type heldSlot struct {
+	mu      sync.Mutex
+	limiter *concurrencyLimiter
+	held    bool
+	waiting int
+}
+
+// pause gives up the slot of the request ctx belongs to, if any.
+func pause(ctx context.Context) *heldSlot {
+	s, _ := ctx.Value(heldSlotKey{}).(*heldSlot)
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.waiting++; s.held {
+		s.held = false
+		s.limiter.release()
+	}
+	return s
+}
+
+// resume takes the slot back, waiting as long as a request queued for it.
+func (s *heldSlot) resume(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.waiting--; s.waiting > 0 || s.held {
+		return nil
+	}
+	timer := time.NewTimer(s.limiter.maxWait)
+	defer timer.Stop()
+	select {
+	case s.limiter.slots <- struct{}{}:
+		s.held = true
+		return nil
+	case <-timer.C:
+		return errBusy
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *heldSlot) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.held {
+		s.held = false
+		s.limiter.release()
+	}
+}
+
+// ipLimiter caps the number of concurrent requests from a single client IP
+// so one client cannot tie up the server with many slow connections.
+type ipLimiter struct {
+	mu      sync.Mutex
+	active  map[string]int
+	limit   int
+	trusted []netip.Prefix
+}
+
+func newIPLimiter(limit int, trusted []netip.Prefix) *ipLimiter {
+	return &ipLimiter{active: map[string]int{}, limit: limit, trusted: trusted}
+}
+
+func (l *ipLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r, l.trusted)
+
+		l.mu.Lock()
+		if l.active[ip] >= l.limit {
+			l.mu.Unlock()
+			w.Header().Set("Retry-After", "1")
+			writeError(w, r, http.StatusTooManyRequests, "too many concurrent requests")
+			return
+		}
+		l.active[ip]++
+		l.mu.Unlock()
+
+		defer func() {
+			l.mu.Lock()
+			if l.active[ip]--; l.active[ip] == 0 {
+				delete(l.active, ip)
+			}
+			l.mu.Unlock()
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// connLimiter caps the number of open connections from a single peer
+// address. Connections beyond the cap are closed as soon as they are
+// accepted, before a slow client can hold them. Trusted proxies are exempt;
+// the clients behind them are only told apart per request, by ipLimiter.
+type connLimiter struct {
+	net.Listener
+	mu      sync.Mutex
+	open    map[string]int
+	limit   int
+	trusted []netip.Prefix
+}
+
+func newConnLimiter(ln net.Listener, limit int, trusted []netip.Prefix) *connLimiter {
+	return &connLimiter{Listener: ln, open: map[string]int{}, limit: limit, trusted: trusted}
+}
+
+func (l *connLimiter) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil || isTrustedProxy(host, l.trusted) {
+			return conn, nil
+		}
+
+		l.mu.Lock()
+		if l.open[host] >= l.limit {
+			l.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		l.open[host]++
+		l.mu.Unlock()
+		return &limitedConn{Conn: conn, release: func() {
+			l.mu.Lock()
+			if l.open[host]--; l.open[host] == 0 {
+				delete(l.open, host)
+			}
+			l.mu.Unlock()
+		}}, nil
+	}
+}
+
+// limitedConn gives its connLimiter slot back when it is closed.
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// clientIP returns the address of the client. When the peer is a trusted
+// proxy, X-Forwarded-For is walked from the right and the first address
+// that is not itself a trusted proxy is used.
+func clientIP(r *http.Request, trusted []netip.Prefix) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(host, trusted) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if !isTrustedProxy(hop, trusted) {
+			return hop
+		}
+		host = hop
+	}
+	return host
+}
+
+func isTrustedProxy(ip string, trusted []netip.Prefix) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range trusted {
+		if prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// maintenanceMode answers 503 while the sentinel file exists, so backend
+// maintenance can be announced by touching a file and ended by removing it.
+func maintenanceMode(sentinel, message string, retryAfter time.Duration) func(http.Handler) http.Handler {
+	seconds := strconv.Itoa(int(retryAfter.Seconds()))
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, err := os.Stat(sentinel); err == nil {
+				w.Header().Set("Retry-After", seconds)
+				writeError(w, r, http.StatusServiceUnavailable, message)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// bodyLimit caps every request body at maxSize bytes. Bodies declared
+// larger are refused with 413 up front; for the rest http.MaxBytesReader
+// stops reading, and closes the connection, once the limit is crossed.
+func bodyLimit(maxSize int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > maxSize {
+				w.Header().Set("Connection", "close")
+				writeError(w, r, http.StatusRequestEntityTooLarge, "request body too large")
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// getBodyGuard deals with GET and HEAD requests that send a body, which no
+// handler reads and which would otherwise hold the connection while a slow
+// client trickles it in. In drain mode up to maxSize bytes are discarded
+// before the request is handled and larger bodies get 413; in reject mode
+// any body gets 400. Either way the connection is closed after an error.
+func getBodyGuard(mode string, maxSize int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead || r.ContentLength == 0 || r.Body == http.NoBody {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if mode == getBodyReject {
+				w.Header().Set("Connection", "close")
+				writeError(w, r, http.StatusBadRequest, "GET requests must not have a body")
+				return
+			}
+			if r.ContentLength > maxSize {
+				w.Header().Set("Connection", "close")
+				writeError(w, r, http.StatusRequestEntityTooLarge, "request body too large")
+				return
+			}
+			n, err := io.Copy(io.Discard, io.LimitReader(r.Body, maxSize+1))
+			if err != nil || n > maxSize {
+				w.Header().Set("Connection", "close")
+				writeError(w, r, http.StatusRequestEntityTooLarge, "request body too large")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// hostLimiter caps concurrent backend fetches per upstream host. Each host
+// has its own slots, so requests to a slow host queue behind each other
+// instead of taking slots from fast ones. A nil hostLimiter does not limit.
+type hostLimiter struct {
+	limit   int
+	maxWait time.Duration
+	mu      sync.Mutex
+	hosts   map[string]*hostSlots
+}
+
+type hostSlots struct {
+	sem   chan struct{}
+	users int // requests holding or waiting for a slot
+}
+
+// fetchLimiter is set from MAX_FETCHES_PER_HOST at startup.
+var fetchLimiter *hostLimiter
+
+func newHostLimiter(limit int, maxWait time.Duration) *hostLimiter {
+	return &hostLimiter{limit: limit, maxWait: maxWait, hosts: map[string]*hostSlots{}}
+}
+
+// acquire waits for a fetch slot for host for up to maxWait, failing with
+// errBusy after that and earlier when ctx is done. The request's own
+// concurrency slot is given up while it waits. The returned function gives
+// the fetch slot back.
+func (l *hostLimiter) acquire(ctx context.Context, host string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	l.mu.Lock()
+	slots, ok := l.hosts[host]
+	if !ok {
+		slots = &hostSlots{sem: make(chan struct{}, l.limit)}
+		l.hosts[host] = slots
+	}
+	slots.users++
+	l.mu.Unlock()
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			<-slots.sem
+			l.leave(host, slots)
+		})
+	}
+	select {
+	case slots.sem <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	slot := pause(ctx)
+	timer := time.NewTimer(l.maxWait)
+	defer timer.Stop()
+	var err error
+	select {
+	case slots.sem <- struct{}{}:
+	case <-timer.C:
+		err = errBusy
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		slot.resume(ctx)
+		l.leave(host, slots)
+		return nil, err
+	}
+	if err := slot.resume(ctx); err != nil {
+		release()
+		return nil, err
+	}
+	return release, nil
+}
+
+// leave forgets a host once nobody uses its slots, so hosts seen once do
+// not accumulate.
+func (l *hostLimiter) leave(host string, slots *hostSlots) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if slots.users--; slots.users == 0 {
+		delete(l.hosts, host)
+	}
+}
+
+// releasingBody gives a fetch slot back when the response body is closed,
+// since the backend connection stays busy until the body is consumed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
@@ -0,0 +1,607 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// holdSlot starts a request through handler that stays in flight until
+// the returned function is called.
+func holdSlot(t *testing.T, handler http.Handler, entered <-chan struct{}, path string) (release func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+		close(done)
+	}()
+	select {
+	case <-entered:
+	case <-time.After(time.Second):
+		t.Fatal("held request never started")
+	}
+	return func() { <-done }
+}
+
+func TestConcurrencyLimiterQueue(t *testing.T) {
+	tests := []struct {
+		name       string
+		queueDepth int
+		maxWait    time.Duration
+		freeAfter  time.Duration // 0 keeps the slot busy
+		want       int
+		minWait    time.Duration
+		maxElapsed time.Duration
+	}{
+		{"no queue", 0, time.Second, 0, http.StatusServiceUnavailable, 0, 500 * time.Millisecond},
+		{"queue timeout", 1, 50 * time.Millisecond, 0, http.StatusServiceUnavailable, 50 * time.Millisecond, time.Second},
+		{"slot freed in time", 1, 2 * time.Second, 20 * time.Millisecond, http.StatusOK, 20 * time.Millisecond, time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entered := make(chan struct{}, 1)
+			unblock := make(chan struct{})
+			limiter := newConcurrencyLimiter(1, tt.queueDepth, tt.maxWait)
+			handler := limiter.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/hold" {
+					entered <- struct{}{}
+					<-unblock
+				}
+			}))
+			wait := holdSlot(t, handler, entered, "/hold")
+			if tt.freeAfter > 0 {
+				time.AfterFunc(tt.freeAfter, func() { close(unblock) })
+			} else {
+				defer close(unblock)
+			}
+
+			start := time.Now()
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/next", nil))
+			elapsed := time.Since(start)
+
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if rec.Code == http.StatusServiceUnavailable && rec.Header().Get("Retry-After") == "" {
+				t.Error("Retry-After missing")
+			}
+			if elapsed < tt.minWait || elapsed > tt.maxElapsed {
+				t.Errorf("answered after %v, want between %v and %v", elapsed, tt.minWait, tt.maxElapsed)
+			}
+			if tt.freeAfter > 0 {
+				wait()
+			}
+		})
+	}
+}
+
+func TestConcurrencyLimiterQueueFull(t *testing.T) {
+	entered := make(chan struct{}, 1)
+	unblock := make(chan struct{})
+	defer close(unblock)
+	limiter := newConcurrencyLimiter(1, 1, time.Second)
+	handler := limiter.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-unblock
+	}))
+	holdSlot(t, handler, entered, "/hold")
+
+	// A second request takes the only queue position.
+	go handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/queued", nil))
+	deadline := time.Now().Add(time.Second)
+	for limiter.queued.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/rejected", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", rec.Code)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("rejected after %v, want immediately", elapsed)
+	}
+}
+
+func TestConcurrencyLimiterRetryAfter(t *testing.T) {
+	tests := []struct {
+		maxWait time.Duration
+		want    string
+	}{
+		{100 * time.Millisecond, "1"},
+		{time.Second, "1"},
+		{2600 * time.Millisecond, "3"},
+	}
+	for _, tt := range tests {
+		limiter := newConcurrencyLimiter(0, 0, tt.maxWait)
+		rec := httptest.NewRecorder()
+		limiter.middleware(http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if got := rec.Header().Get("Retry-After"); got != tt.want {
+			t.Errorf("maxWait %v: Retry-After = %q, want %q", tt.maxWait, got, tt.want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("::1/128")}
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		trusted      []netip.Prefix
+		want         string
+	}{
+		{"direct", "203.0.113.7:1234", nil, trusted, "203.0.113.7"},
+		{"untrusted peer ignores header", "203.0.113.7:1234", []string{"198.51.100.1"}, trusted, "203.0.113.7"},
+		{"trusted proxy", "10.0.0.2:1234", []string{"198.51.100.1"}, trusted, "198.51.100.1"},
+		{"proxy chain", "10.0.0.2:1234", []string{"198.51.100.1, 10.0.0.3"}, trusted, "198.51.100.1"},
+		{"spoofed left hop", "10.0.0.2:1234", []string{"1.2.3.4, 198.51.100.1"}, trusted, "198.51.100.1"},
+		{"repeated headers", "10.0.0.2:1234", []string{"1.2.3.4", "198.51.100.1"}, trusted, "198.51.100.1"},
+		{"only proxies", "10.0.0.2:1234", []string{"10.0.0.3"}, trusted, "10.0.0.3"},
+		{"no header", "10.0.0.2:1234", nil, trusted, "10.0.0.2"},
+		{"ipv6 proxy", "[::1]:1234", []string{"2001:db8::1"}, trusted, "2001:db8::1"},
+		{"nothing trusted", "10.0.0.2:1234", []string{"198.51.100.1"}, nil, "10.0.0.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwardedFor {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if got := clientIP(r, tt.trusted); got != tt.want {
+				t.Errorf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPLimiter(t *testing.T) {
+	entered := make(chan struct{}, 1)
+	unblock := make(chan struct{})
+	handler := newIPLimiter(1, nil).middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hold" {
+			entered <- struct{}{}
+			<-unblock
+		}
+	}))
+	// httptest requests come from 192.0.2.1.
+	wait := holdSlot(t, handler, entered, "/hold")
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		want       int
+	}{
+		{"same client", "192.0.2.1:5555", http.StatusTooManyRequests},
+		{"other client", "192.0.2.2:5555", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/next", nil)
+			r.RemoteAddr = tt.remoteAddr
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, r)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if tt.want == http.StatusTooManyRequests && rec.Header().Get("Retry-After") == "" {
+				t.Error("Retry-After missing")
+			}
+		})
+	}
+
+	close(unblock)
+	wait()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/next", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("status after release = %d, want 200", rec.Code)
+	}
+}
+
+func TestConnLimiter(t *testing.T) {
+	tests := []struct {
+		name       string
+		trusted    []netip.Prefix
+		wantServed int
+	}{
+		{"over the cap", nil, 2},
+		{"trusted proxy exempt", []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")}, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+			go srv.Serve(newConnLimiter(ln, 2, tt.trusted))
+			t.Cleanup(func() { srv.Close() })
+
+			// Every connection stays open while the next one is made.
+			served := 0
+			for range 4 {
+				conn, err := net.Dial("tcp", ln.Addr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				io.WriteString(conn, "GET / HTTP/1.1\r\nHost: cdn\r\n\r\n")
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				if resp, err := http.ReadResponse(bufio.NewReader(conn), nil); err == nil && resp.StatusCode == http.StatusOK {
+					served++
+				}
+			}
+			if served != tt.wantServed {
+				t.Errorf("served %d connections, want %d", served, tt.wantServed)
+			}
+		})
+	}
+}
+
+func TestConnLimiterRelease(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go srv.Serve(newConnLimiter(ln, 1, nil))
+	t.Cleanup(func() { srv.Close() })
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+	// Each connection is closed after its response, freeing the slot for
+	// the next once the server has closed its end.
+	for i := range 3 {
+		deadline := time.Now().Add(time.Second)
+		for {
+			resp, err := client.Get("http://" + ln.Addr().String())
+			if err == nil {
+				resp.Body.Close()
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("request %d: %s", i, err)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	sentinel := filepath.Join(t.TempDir(), "maintenance")
+	handler := maintenanceMode(sentinel, "back soon", 90*time.Second)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name    string
+		present bool
+		want    int
+	}{
+		{"no sentinel", false, http.StatusOK},
+		{"sentinel", true, http.StatusServiceUnavailable},
+		{"sentinel removed", false, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.present {
+				if err := os.WriteFile(sentinel, nil, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				os.Remove(sentinel)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/assets/a.txt", nil))
+
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if tt.want != http.StatusServiceUnavailable {
+				return
+			}
+			if got := rec.Header().Get("Retry-After"); got != "90" {
+				t.Errorf("Retry-After = %q, want 90", got)
+			}
+			if !strings.Contains(rec.Body.String(), "back soon") {
+				t.Errorf("body = %q, want the maintenance message", rec.Body)
+			}
+		})
+	}
+}
+
+func TestGetBodyGuard(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       string
+		method     string
+		body       string
+		length     int64 // -1 sends the body without a declared length
+		wantStatus int
+		wantClose  bool
+	}{
+		{"no body", getBodyReject, http.MethodGet, "", 0, http.StatusOK, false},
+		{"post not guarded", getBodyReject, http.MethodPost, "data", 4, http.StatusOK, false},
+		{"ignore", getBodyIgnore, http.MethodGet, "data", 4, http.StatusOK, false},
+		{"reject", getBodyReject, http.MethodGet, "data", 4, http.StatusBadRequest, true},
+		{"reject head", getBodyReject, http.MethodHead, "data", 4, http.StatusBadRequest, true},
+		{"drain small", getBodyDrain, http.MethodGet, "data", 4, http.StatusOK, false},
+		{"drain at limit", getBodyDrain, http.MethodGet, "12345678", 8, http.StatusOK, false},
+		{"drain declared too large", getBodyDrain, http.MethodGet, "123456789", 9, http.StatusRequestEntityTooLarge, true},
+		{"drain undeclared small", getBodyDrain, http.MethodGet, "data", -1, http.StatusOK, false},
+		{"drain undeclared too large", getBodyDrain, http.MethodGet, "123456789", -1, http.StatusRequestEntityTooLarge, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var read string
+			handler := getBodyGuard(tt.mode, 8)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				data, _ := io.ReadAll(r.Body)
+				read = string(data)
+			}))
+			req := httptest.NewRequest(tt.method, "/assets/a.txt", strings.NewReader(tt.body))
+			req.ContentLength = tt.length
+			if tt.body == "" {
+				req.Body = http.NoBody
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Connection") == "close"; got != tt.wantClose {
+				t.Errorf("Connection close = %v, want %v", got, tt.wantClose)
+			}
+			if tt.mode == getBodyDrain && tt.wantStatus == http.StatusOK && read != "" {
+				t.Errorf("handler read %q after draining", read)
+			}
+		})
+	}
+}
+
+func TestHostLimiter(t *testing.T) {
+	l := newHostLimiter(1, time.Second)
+	releaseSlow, err := l.acquire(context.Background(), "slow:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		host    string
+		wantErr bool
+	}{
+		{"other host", "fast:80", false},
+		{"same host waits", "slow:80", true},
+		{"same host other port", "slow:8080", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			release, err := l.acquire(ctx, tt.host)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("acquire(%q) err = %v, want error: %v", tt.host, err, tt.wantErr)
+			}
+			if err == nil {
+				release()
+				release() // releasing twice must not free a second slot
+			}
+		})
+	}
+
+	releaseSlow()
+	if len(l.hosts) != 0 {
+		t.Errorf("limiter still tracks %d hosts", len(l.hosts))
+	}
+	release, err := l.acquire(context.Background(), "slow:80")
+	if err != nil {
+		t.Fatalf("acquire after release: %v", err)
+	}
+	release()
+
+	busy := newHostLimiter(1, 10*time.Millisecond)
+	releaseBusy, _ := busy.acquire(context.Background(), "slow:80")
+	if _, err := busy.acquire(context.Background(), "slow:80"); !errors.Is(err, errBusy) {
+		t.Errorf("acquire past maxWait err = %v, want %v", err, errBusy)
+	}
+	releaseBusy()
+
+	var unlimited *hostLimiter
+	if _, err := unlimited.acquire(context.Background(), "any"); err != nil {
+		t.Errorf("nil limiter: %v", err)
+	}
+}
+
+func TestFetchesPerHost(t *testing.T) {
+	entered := make(chan struct{}, 1)
+	unblock := make(chan struct{})
+	slow := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/assets/hold.txt" {
+			entered <- struct{}{}
+			<-unblock
+		}
+		w.Write([]byte("slow"))
+	})
+	fast := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fast"))
+	})
+	cfg := testConfig(t, slow.URL, map[string]string{"MAX_FETCHES_PER_HOST": "1", "FETCH_QUEUE_TIMEOUT": "20ms"})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serve(cfg, nil, r)
+	})
+	wait := holdSlot(t, handler, entered, "/assets/hold.txt")
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+	}{
+		{"fast host not starved", "/assets/" + url.QueryEscape(fast.URL+"/a.txt"), http.StatusOK},
+		{"slow host queued", "/assets/b.txt", http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(cfg, nil, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusServiceUnavailable && rec.Header().Get("Retry-After") == "" {
+				t.Error("Retry-After missing")
+			}
+		})
+	}
+
+	close(unblock)
+	wait()
+	if rec := serve(cfg, nil, httptest.NewRequest(http.MethodGet, "/assets/b.txt", nil)); rec.Code != http.StatusOK {
+		t.Errorf("status after the slow fetch finished = %d, want 200", rec.Code)
+	}
+}
+
+func TestFetchWaitYieldsSlot(t *testing.T) {
+	entered := make(chan struct{}, 1)
+	unblock := make(chan struct{})
+	slow := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/assets/hold.txt" {
+			entered <- struct{}{}
+			<-unblock
+		}
+		w.Write([]byte("slow"))
+	})
+	fast := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fast"))
+	})
+	cfg := testConfig(t, slow.URL, map[string]string{"MAX_FETCHES_PER_HOST": "1"})
+	limiter := newConcurrencyLimiter(2, 0, time.Second)
+	handler := limiter.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := serve(cfg, nil, r)
+		w.WriteHeader(rec.Code)
+		w.Write(rec.Body.Bytes())
+	}))
+	wait := holdSlot(t, handler, entered, "/assets/hold.txt")
+
+	// A second request to the slow host waits for its fetch slot without
+	// keeping the last concurrency slot.
+	queued := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/assets/b.txt", nil))
+		queued <- rec
+	}()
+	waiting := func() bool {
+		fetchLimiter.mu.Lock()
+		defer fetchLimiter.mu.Unlock()
+		slots := fetchLimiter.hosts[strings.TrimPrefix(slow.URL, "http://")]
+		return slots != nil && slots.users == 2 && len(limiter.slots) == 1
+	}
+	deadline := time.Now().Add(time.Second)
+	for !waiting() {
+		if time.Now().After(deadline) {
+			t.Fatal("waiting request kept its concurrency slot")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/assets/"+url.QueryEscape(fast.URL+"/a.txt"), nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("fast host status = %d, want 200", rec.Code)
+	}
+
+	close(unblock)
+	wait()
+	if rec := <-queued; rec.Code != http.StatusOK {
+		t.Errorf("queued request status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	if len(limiter.slots) != 0 {
+		t.Errorf("%d concurrency slots still held", len(limiter.slots))
+	}
+}
+
+func TestBodyLimit(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		length     int64 // -1 sends the body without a declared length
+		wantStatus int
+		wantRead   string
+		wantErr    bool
+	}{
+		{"within limit", "data", 4, http.StatusOK, "data", false},
+		{"at limit", "12345678", 8, http.StatusOK, "12345678", false},
+		{"declared too large", "123456789", 9, http.StatusRequestEntityTooLarge, "", false},
+		{"undeclared within limit", "data", -1, http.StatusOK, "data", false},
+		{"undeclared too large", "123456789", -1, http.StatusOK, "12345678", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var read string
+			var readErr error
+			handler := bodyLimit(8)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				data, err := io.ReadAll(r.Body)
+				read, readErr = string(data), err
+			}))
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			req.ContentLength = tt.length
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if read != tt.wantRead {
+				t.Errorf("handler read %q, want %q", read, tt.wantRead)
+			}
+			if (readErr != nil) != tt.wantErr {
+				t.Errorf("read error = %v, want error: %v", readErr, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        map[string]string
+		headerSize int
+		want       int
+	}{
+		{"default allows large cookies", nil, 32 << 10, http.StatusOK},
+		{"default limit", nil, 80 << 10, http.StatusRequestHeaderFieldsTooLarge},
+		{"configured limit", map[string]string{"MAX_HEADER_BYTES": "1024"}, 8 << 10, http.StatusRequestHeaderFieldsTooLarge},
+		{"configured limit allows small", map[string]string{"MAX_HEADER_BYTES": "1024"}, 512, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, "http://backend.invalid", tt.env)
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			srv.Config.MaxHeaderBytes = cfg.maxHeaderBytes
+			srv.Start()
+			defer srv.Close()
+
+			req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+			req.Header.Set("Cookie", strings.Repeat("a", tt.headerSize))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
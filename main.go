@@ -1,17 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
+	"image"
 	"io"
 	"log"
+	"maps"
 	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -23,39 +32,97 @@ import (
 const (
 	serverPort       = ":8080"
 	cacheMaxAge      = "max-age=31536000, public"
+	cacheNoStore     = "private, no-store"
 	defaultMediaType = "application/octet-stream"
+	maxDPR           = 5.0
 )
 
 func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
 	defer cancel()
 
-	// Validate required environment variables
-	assetsApiHost := os.Getenv("ASSETS_API_HOST")
-	resizerApiHost := os.Getenv("RESIZER_API_HOST")
-
-	if assetsApiHost == "" {
-		log.Fatal("ASSETS_API_HOST environment variable is required")
-	}
-
-	if resizerApiHost == "" {
-		log.Fatal("RESIZER_API_HOST environment variable is required")
+	cfg := loadConfig()
+	gzipLevel = cfg.gzipLevel
+	gzipMinSize = cfg.gzipMinSize
+	httpClient = newHTTPClient(cfg)
+	maps.Copy(extensionTypes, cfg.contentTypes)
+	blurhashes.Store(newBlurhashCache(cfg.blurhashCacheSize))
+	if cfg.maxFetchesPerHost > 0 {
+		fetchLimiter = newHostLimiter(cfg.maxFetchesPerHost, cfg.fetchQueueTimeout)
 	}
 
 	r := chi.NewRouter()
+	r.Use(middleware.RequestID)
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
+	r.Use(proxyVersion)
+	r.Use(bodyLimit(cfg.maxBodySize))
+	if cfg.noSniff {
+		r.Use(noSniff)
+	}
+	if cfg.getBody != getBodyIgnore {
+		r.Use(getBodyGuard(cfg.getBody, cfg.getBodyMaxSize))
+	}
+	if cfg.canonicalHost != "" {
+		r.Use(canonicalHostRedirect(cfg.canonicalHost))
+	}
+	if cfg.nelReportURL != "" {
+		r.Use(networkErrorLogging(cfg.nelReportURL, cfg.nelMaxAge))
+	}
+	if cfg.enableTestHooks {
+		log.Println("WARNING: test hooks are enabled, do not run this in production")
+		r.Use(testHooks)
+	}
 
-	r.Get("/assets/*", assetsHandler(assetsApiHost, resizerApiHost))
+	r.Get("/version", versionHandler)
+
+	var errs *errorLog
+	if cfg.debugToken != "" {
+		errs = newErrorLog(cfg.debugErrors)
+		r.Get("/debug/errors", requireToken(cfg.debugToken, debugErrorsHandler(errs)))
+		r.Get("/debug/vars", requireToken(cfg.debugToken, expvar.Handler().ServeHTTP))
+		r.Post("/debug/flush", requireToken(cfg.debugToken, flushCacheHandler))
+	}
+
+	r.Group(func(r chi.Router) {
+		if cfg.maintenanceFile != "" {
+			r.Use(maintenanceMode(cfg.maintenanceFile, cfg.maintenanceMessage, cfg.maintenanceRetryAfter))
+		}
+		if cfg.maxRequestsPerIP > 0 {
+			r.Use(newIPLimiter(cfg.maxRequestsPerIP, cfg.trustedProxies).middleware)
+		}
+		if cfg.maxConcurrent > 0 {
+			r.Use(newConcurrencyLimiter(cfg.maxConcurrent, cfg.queueDepth, cfg.queueTimeout).middleware)
+		}
+		if cfg.requestBudget > 0 {
+			r.Use(requestBudget(cfg.requestBudget))
+		}
+		r.Get("/assets/*", assetsHandler(cfg, errs))
+		r.Get("/sprite", spriteHandler(cfg))
+		if len(cfg.variantWidths) > 0 {
+			r.Get("/manifest/*", manifestHandler(cfg))
+		}
+	})
 
 	srv := &http.Server{
 		Addr:    serverPort,
-		Handler: r,
+		Handler: serverOptions(r),
+		// serverOptions answers OPTIONS * itself so it can list Allow.
+		DisableGeneralOptionsHandler: true,
+		MaxHeaderBytes:               cfg.maxHeaderBytes,
+	}
+
+	ln, err := net.Listen("tcp", serverPort)
+	if err != nil {
+		log.Fatalf("listen: %s\n", err)
+	}
+	if cfg.maxConnsPerIP > 0 {
+		ln = newConnLimiter(ln, cfg.maxConnsPerIP, cfg.trustedProxies)
 	}
 
 	go func() {
 		log.Println("Starting server on", serverPort)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("listen: %s\n", err)
 		}
 	}()
@@ -72,93 +139,851 @@ func main() {
 	log.Println("Server exiting")
 }
 
+// serverOptions answers the server-wide "OPTIONS *" request with the
+// methods allowed anywhere on the server instead of routing it.
+func serverOptions(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions && r.RequestURI == "*" {
+			w.Header().Set("Allow", "GET, OPTIONS")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// canonicalHostRedirect permanently redirects requests that arrive on any
+// other host to the canonical one. Debug endpoints are left alone so they
+// can be reached on an instance directly.
+func canonicalHostRedirect(host string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.EqualFold(r.Host, host) || strings.HasPrefix(r.URL.Path, "/debug/") {
+				next.ServeHTTP(w, r)
+				return
+			}
+			http.Redirect(w, r, requestScheme(r)+"://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+		})
+	}
+}
+
+// networkErrorLogging adds NEL and Report-To headers so browsers report
+// failed loads from this host to the collector at reportURL.
+func networkErrorLogging(reportURL string, maxAge time.Duration) func(http.Handler) http.Handler {
+	seconds := int(maxAge.Seconds())
+	reportTo, _ := json.Marshal(map[string]any{
+		"group":     "cdn-errors",
+		"max_age":   seconds,
+		"endpoints": []map[string]string{{"url": reportURL}},
+	})
+	nel := fmt.Sprintf(`{"report_to":"cdn-errors","max_age":%d}`, seconds)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Report-To", string(reportTo))
+			w.Header().Set("NEL", nel)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// noSniff stops browsers from second-guessing the Content-Type of any
+// response, which getContentTypeFromFilename and the backends already set.
+func noSniff(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestScheme returns the scheme the client used, trusting
+// X-Forwarded-Proto from a TLS-terminating proxy.
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		return "https"
+	}
+	return "http"
+}
+
 func isValidURL(str string) bool {
 	u, err := url.Parse(str)
 	return err == nil && u.Scheme != "" && u.Host != ""
 }
 
-func assetsHandler(assetsApiHost, resizerApiHost string) http.HandlerFunc {
+// problem is an RFC 7807 problem details object.
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail"`
+	Instance string `json:"instance"`
+}
+
+// writeError writes a JSON error body. Clients that ask for
+// application/problem+json get RFC 7807 problem details instead of the
+// default {"error": "..."} object.
+func writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	var body []byte
+	w.Header().Add("Vary", "Accept")
+	if strings.Contains(r.Header.Get("Accept"), "application/problem+json") {
+		body, _ = json.Marshal(problem{
+			Type:     "about:blank",
+			Title:    http.StatusText(status),
+			Status:   status,
+			Detail:   message,
+			Instance: r.URL.Path,
+		})
+		w.Header().Set("Content-Type", "application/problem+json")
+	} else {
+		body, _ = json.Marshal(map[string]string{"error": message})
+		w.Header().Set("Content-Type", "application/json")
+	}
+	writeBody(w, r, status, append(body, '\n'))
+}
+
+func assetsHandler(cfg *config, errs *errorLog) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		timing := newServerTiming()
 		path := strings.Trim(chi.URLParam(r, "*"), "/")
 		if path == "" {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": "path is required"})
+			writeError(w, r, http.StatusBadRequest, "path is required")
 			return
 		}
 
 		urlPath, err := url.QueryUnescape(path)
 		if err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": "invalid path"})
+			writeError(w, r, http.StatusBadRequest, "invalid path")
+			return
+		}
+
+		if len(cfg.trackingParams) > 0 {
+			urlPath = stripTracking(r, urlPath, cfg.trackingParams)
+		}
+
+		if cfg.denyPaths != nil && cfg.denyPaths.MatchString(urlPath) {
+			if cfg.logDenied {
+				log.Printf("debug: denylist: %s %q", middleware.GetReqID(r.Context()), urlPath)
+			}
+			writeError(w, r, http.StatusNotFound, "not found")
+			return
+		}
+
+		if cfg.caseInsensitiveParams {
+			foldParamCase(r)
+		}
+
+		if cfg.duplicateParams == duplicateParamsReject {
+			if name := duplicateParam(r.URL.Query(), queryParams); name != "" {
+				writeError(w, r, http.StatusBadRequest, fmt.Sprintf("duplicate query parameter: %s", name))
+				return
+			}
+		}
+
+		if err := expandPreset(r, cfg); err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if isDataURL(urlPath) {
+			resp, err := dataURLResponse(urlPath, cfg.maxDataURLSize, cfg.resizableTypes)
+			if err == errDataURLTooLarge {
+				writeError(w, r, http.StatusRequestEntityTooLarge, err.Error())
+				return
+			}
+			if err == errDataURLType {
+				writeError(w, r, http.StatusUnsupportedMediaType, err.Error())
+				return
+			}
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, err.Error())
+				return
+			}
+			// The content comes from the caller, not from us, so it is
+			// not worth a shared cache entry.
+			setResponseHeaders(w, resp, cfg, defaultMediaType, cacheNoStore)
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, resp.Body)
 			return
 		}
 
 		mediaType := getContentTypeFromFilename(urlPath)
+		cacheControl := cacheControlFor(cfg, urlPath)
 
-		fullURL := buildFullURL(r, assetsApiHost, resizerApiHost, urlPath)
+		if wantsResize(r) && !isResizable(cfg, mediaType) {
+			writeError(w, r, http.StatusUnsupportedMediaType, fmt.Sprintf("cannot resize %s source as image", mediaType))
+			return
+		}
 
-		resp, err := fetchAsset(fullURL)
+		t, err := buildFullURL(r, cfg, urlPath, backendOverride(r, cfg))
 		if err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(map[string]string{"error": "Error fetching asset"})
+			writeError(w, r, http.StatusBadRequest, err.Error())
 			return
 		}
+
+		hotlinkChecked := len(cfg.hotlinkAllowedHosts) > 0 && (strings.HasPrefix(mediaType, "image/") || t.resized)
+		if hotlinkChecked && !checkHotlink(w, r, cfg, &t.vary) {
+			return
+		}
+
+		if r.URL.Query().Get("blurhash") == "1" {
+			if !isResizable(cfg, mediaType) {
+				writeError(w, r, http.StatusUnsupportedMediaType, fmt.Sprintf("cannot compute blurhash of %s source", mediaType))
+				return
+			}
+			serveBlurhash(w, r, cfg, urlPath, t)
+			return
+		}
+
+		// The source is looked up before resizing, both for its size and
+		// for a validator that changes when it is replaced. Without one the
+		// output gets no ETag, since a stale 304 could never be corrected.
+		fetchStart := time.Now()
+		var resp *http.Response
+		var encoding string
+		var shielded bool
+		if viaShield(r, cfg) {
+			// The shield has done any processing already; only an encoding
+			// it applied, such as a precompressed variant, is kept.
+			if resp = fetchShield(r, cfg, t); resp != nil {
+				shielded = true
+				if !resp.Uncompressed {
+					encoding = resp.Header.Get("Content-Encoding")
+				}
+			}
+		}
+		// The source is looked up only when its size decides whether to
+		// resize, or when a revalidation may be answered without the
+		// resizer; behind a shield, the shield does it.
+		var etag string
+		if t.resized && !shielded && (cfg.resizeMinSourceSize > 0 || r.Header.Get("If-None-Match") != "") {
+			source, err := headAsset(r.Context(), t.sourceURL, t.sourceBackend, upstreamHeaders(r, cfg, t.original()))
+			if err == nil && skipSmallSource(cfg, source) {
+				t = t.original()
+			} else if err == nil && source.validator != "" {
+				etag = resizedETag(t.url, source.validator)
+			}
+		}
+		if etag != "" {
+			if etagMatches(r.Header.Get("If-None-Match"), etag) {
+				t.vary.apply(w.Header())
+				writeNotModified(w, etag, cacheControl)
+				return
+			}
+		}
+		if resp == nil && cfg.precompressed && t.backend == backendAssets {
+			t.vary.add("Accept-Encoding")
+			resp, encoding = fetchPrecompressed(r, cfg, t)
+		}
+		if resp == nil {
+			if t.resized && cfg.resizeTimeout > 0 {
+				var fellBack bool
+				resp, fellBack, err = fetchResizeBehind(r, cfg, &t)
+				if fellBack {
+					etag = ""
+				}
+				if fellBack && cacheControl != cacheNoStore {
+					cacheControl = fmt.Sprintf("max-age=%d, public", int(cfg.resizeFallbackTTL.Seconds()))
+				}
+			} else {
+				resp, err = fetchAsset(r.Context(), t.url, t.backend, upstreamHeaders(r, cfg, t))
+			}
+			if err != nil {
+				resp, err = fetchFallback(r, cfg, urlPath, &t, err)
+			}
+			if err != nil && cfg.localAssetsDir != "" && !t.resized && t.backend == backendAssets {
+				if serveLocal(w, r, cfg, urlPath, mediaType, cacheControl) {
+					return
+				}
+			}
+			if err != nil {
+				if se, ok := err.(*statusError); ok && se.code == http.StatusRequestedRangeNotSatisfiable {
+					writeError(w, r, se.code, "range not satisfiable")
+					return
+				}
+				if errors.Is(err, errBusy) {
+					w.Header().Set("Retry-After", "1")
+					writeError(w, r, http.StatusServiceUnavailable, "backend is busy")
+					return
+				}
+				errs.record(r, http.StatusInternalServerError, t.url, err)
+				writeError(w, r, http.StatusInternalServerError, "Error fetching asset")
+				return
+			}
+			// Validators the resizer sends itself are preferred over the
+			// source's, as they are at hand on every request.
+			if v := validator(resp.Header); t.resized && v != "" {
+				etag = resizedETag(t.url, v)
+			}
+			// With PRECOMPRESSED, an explicitly requested .br file is
+			// brotli-encoded content of the underlying type, labelled as
+			// such for clients that can decode it. Others get the file as
+			// it is.
+			if cfg.precompressed && !t.resized && hasCompressionSuffix(urlPath) {
+				t.vary.add("Accept-Encoding")
+				if acceptsEncoding(r, "br") {
+					encoding = "br"
+				}
+			}
+		}
 		defer resp.Body.Close()
+		timing.measure("fetch", fetchStart)
+
+		// An image without an image extension is only recognised by the
+		// Content-Type it arrives with.
+		if len(cfg.hotlinkAllowedHosts) > 0 && !hotlinkChecked && hasContentTypePrefix(resp.Header.Get("Content-Type"), []string{"image/"}) {
+			if !checkHotlink(w, r, cfg, &t.vary) {
+				return
+			}
+		}
+
+		if cfg.strictSniffing {
+			dangerous, err := dangerousContent(resp, mediaType)
+			if err != nil {
+				errs.record(r, http.StatusBadGateway, t.url, err)
+				writeError(w, r, http.StatusBadGateway, "Error reading asset")
+				return
+			}
+			if dangerous {
+				errs.record(r, http.StatusForbidden, t.url, fmt.Errorf("content does not match %s", mediaType))
+				writeError(w, r, http.StatusForbidden, "asset content does not match its type")
+				return
+			}
+		}
+
+		var buffered bool
+		if limit := bufferLimit(cfg, r, resp, mediaType); limit > 0 {
+			buffered, err = bufferBody(resp, limit)
+			if err != nil {
+				errs.record(r, http.StatusBadGateway, t.url, err)
+				writeError(w, r, http.StatusBadGateway, "Error reading asset")
+				return
+			}
+			// A body of unknown length that is streamed to an HTTP/1.0
+			// client is delimited by closing the connection.
+			if !buffered && !r.ProtoAtLeast(1, 1) && resp.ContentLength < 0 {
+				w.Header().Set("Connection", "close")
+			}
+		}
+
+		// A shield response has been through the shield's transformers.
+		var transformed bool
+		if len(cfg.transformers) > 0 && encoding == "" && !shielded {
+			transformStart := time.Now()
+			transformed, err = applyTransforms(r, cfg, resp, mediaType)
+			if err != nil {
+				errs.record(r, http.StatusBadGateway, t.url, err)
+				writeError(w, r, http.StatusBadGateway, "Error reading asset")
+				return
+			}
+			if transformed {
+				buffered = true
+				timing.measure("transform", transformStart)
+			}
+		}
+
+		setResponseHeaders(w, resp, cfg, mediaType, cacheControl)
+		if encoding != "" {
+			// The backend labels the variant by its .br name, so the type is
+			// taken from the original extension instead.
+			w.Header().Set("Content-Encoding", encoding)
+			if mediaType != defaultMediaType {
+				w.Header().Set("Content-Type", mediaType)
+				setHardeningHeaders(w.Header(), cfg, mediaType)
+			}
+		}
+		if t.dpr != "" {
+			w.Header().Set("Content-DPR", t.dpr)
+		}
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+		modified := lastModified(resp, cfg, hasCacheDirective(w.Header(), "immutable"))
+		if !modified.IsZero() {
+			w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+		}
+		if cfg.resizedHeader != "" {
+			w.Header().Set(cfg.resizedHeader, strconv.FormatBool(t.resized))
+		}
+		// Ranges of the original do not line up with a processed body, and
+		// any Range was answered with the whole body, so none are offered.
+		if t.resized || transformed {
+			w.Header().Del("Accept-Ranges")
+		}
+		if t.resized {
+			setImageDimensions(w, resp, buffered)
+			if cfg.canonicalLinks {
+				w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"canonical\"", canonicalURL(r)))
+			}
+		}
+		gzipped := encoding == "" && gzipStream(r, cfg, resp, w.Header().Get("Content-Type"), &t.vary)
+		if gzipped {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Del("Content-Length")
+			w.Header().Del("Accept-Ranges")
+		}
+		if etag == "" && cfg.generateETags && resp.StatusCode == http.StatusOK {
+			// The backend's own ETag is kept unless it describes a body a
+			// transformer has since rewritten.
+			if etag = resp.Header.Get("ETag"); etag == "" || transformed {
+				etag = assetETag(resp, buffered, t.url, modified)
+			}
+			if etag != "" {
+				if gzipped && !strings.HasPrefix(etag, "W/") {
+					etag = "W/" + etag
+				}
+				w.Header().Set("ETag", etag)
+			}
+		}
+		if cfg.serverTiming {
+			w.Header().Set("Server-Timing", timing.header())
+		}
+		t.vary.apply(w.Header())
+		if resp.StatusCode == http.StatusOK && (etagMatches(r.Header.Get("If-None-Match"), etag) || notModifiedSince(r, modified)) {
+			for _, name := range []string{"Content-Length", "Content-Type", "Content-Encoding"} {
+				w.Header().Del(name)
+			}
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if cfg.emptyAsNoContent && resp.StatusCode == http.StatusOK && resp.ContentLength == 0 {
+			w.Header().Del("Content-Length")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(resp.StatusCode)
+		var n int64
+		if gzipped {
+			gz, _ := gzip.NewWriterLevel(w, gzipLevel)
+			n, _ = io.Copy(gz, resp.Body)
+			gz.Close()
+		} else {
+			n, _ = io.Copy(w, resp.Body)
+		}
+		recordBytesServed(w.Header().Get("Content-Type"), t.resized, n)
+	}
+}
+
+// target is the resolved upstream location for an asset request along with
+// the processing options that were applied to it.
+type target struct {
+	url     string
+	dpr     string // DPR passed to the resizer, empty when none was applied
+	vary    varySet
+	resized bool
+	backend string // backendAssets, backendResizer, or empty for external URLs
+
+	// sourceURL and sourceBackend locate the unprocessed asset.
+	sourceURL     string
+	sourceBackend string
+}
+
+// original returns the target for the unprocessed source of t, keeping the
+// Vary headers already consulted.
+func (t target) original() target {
+	return target{url: t.sourceURL, backend: t.sourceBackend, sourceURL: t.sourceURL, sourceBackend: t.sourceBackend, vary: t.vary}
+}
+
+const (
+	backendAssets  = "assets"
+	backendResizer = "resizer"
+)
+
+// varySet collects the request headers that actually influenced a response.
+// Features add a header only when they used it, so the emitted Vary neither
+// fragments caches needlessly nor misses a variant.
+type varySet []string
+
+func (v *varySet) add(name string) {
+	name = http.CanonicalHeaderKey(name)
+	for _, existing := range *v {
+		if existing == name {
+			return
+		}
+	}
+	*v = append(*v, name)
+}
 
-		setResponseHeaders(w, resp, mediaType)
-		io.Copy(w, resp.Body)
+func (v varySet) apply(h http.Header) {
+	if len(v) > 0 {
+		h.Set("Vary", strings.Join(v, ", "))
 	}
 }
 
-func buildFullURL(r *http.Request, assetsApiHost, resizerApiHost, urlPath string) string {
+// queryParams lists the query parameters that influence a response. Every
+// parameter is read with url.Values.Get, so the first value wins unless
+// DUPLICATE_PARAMS=reject turns repeats into a 400.
+var queryParams = []string{"type", "w", "h", "aq", "ra", "fpx", "fpy", "maxbytes", "preset", "lossless", "blurhash"}
+
+// resizingAlgorithms are the values the resizer accepts for ?ra=.
+var resizingAlgorithms = []string{"nearest", "linear", "cubic", "lanczos2", "lanczos3"}
+
+// expandPreset replaces ?preset=name with the parameters configured for
+// that preset in RESIZE_PRESETS. Parameters given explicitly in the request
+// take precedence over the preset's.
+func expandPreset(r *http.Request, cfg *config) error {
+	q := r.URL.Query()
+	name := q.Get("preset")
+	if name == "" {
+		return nil
+	}
+	preset, ok := cfg.resizePresets[name]
+	if !ok {
+		return fmt.Errorf("unknown preset: %s", name)
+	}
+	q.Del("preset")
+	for key, values := range preset {
+		if !q.Has(key) {
+			q[key] = values
+		}
+	}
+	r.URL.RawQuery = q.Encode()
+	return nil
+}
+
+// foldParamCase rewrites known query parameters given in another case,
+// such as ?W=100, to their canonical lowercase names so later lookups find
+// them. The query keeps its order, so the first value still wins. Values
+// and unknown parameters, which may be case-sensitive for the backend, are
+// left alone.
+func foldParamCase(r *http.Request) {
+	pairs := strings.Split(r.URL.RawQuery, "&")
+	changed := false
+	for i, pair := range pairs {
+		key, value, hasValue := strings.Cut(pair, "=")
+		key, err := url.QueryUnescape(key)
+		if err != nil {
+			continue
+		}
+		name := strings.ToLower(key)
+		if name == key || !slices.Contains(queryParams, name) {
+			continue
+		}
+		if pairs[i] = name; hasValue {
+			pairs[i] += "=" + value
+		}
+		changed = true
+	}
+	if changed {
+		r.URL.RawQuery = strings.Join(pairs, "&")
+	}
+}
+
+// duplicateParam returns the first of names that was supplied more than
+// once in q, or an empty string.
+func duplicateParam(q url.Values, names []string) string {
+	for _, name := range names {
+		if len(q[name]) > 1 {
+			return name
+		}
+	}
+	return ""
+}
+
+// buildFullURL resolves an asset path to its upstream URL, with relative
+// paths served from assetsHost, routing it through the resizer when an
+// image transformation was requested.
+func buildFullURL(r *http.Request, cfg *config, urlPath, assetsHost string) (target, error) {
+	var backend string
 	if !isValidURL(urlPath) {
-		urlPath = fmt.Sprintf("%s/assets/%s", assetsApiHost, urlPath)
+		urlPath = fmt.Sprintf("%s/assets/%s", assetsHost, urlPath)
+		backend = backendAssets
 	}
 
-	contentType := r.URL.Query().Get("type")
+	q := r.URL.Query()
 
-	if contentType == "image" {
-		width := r.URL.Query().Get("w")
-		height := r.URL.Query().Get("h")
-		u, _ := url.Parse(resizerApiHost)
-		var comp string
-		if width != "" && height == "" {
-			comp = fmt.Sprintf("w:%s", width)
+	if wantsResize(r) {
+		width := q.Get("w")
+		height := q.Get("h")
+		u, _ := url.Parse(cfg.resizerApiHost)
+		var opts []string
+		if width != "" {
+			opts = append(opts, fmt.Sprintf("w:%s", width))
+		}
+		if height != "" {
+			opts = append(opts, fmt.Sprintf("h:%s", height))
+		}
+		// DPR only scales explicit dimensions, so it is applied (and echoed
+		// back as Content-DPR) only when a width or height was requested.
+		// The hints are consulted either way, so both are listed in Vary.
+		var dpr string
+		var vary varySet
+		if len(opts) > 0 {
+			vary.add("Sec-CH-DPR")
+			vary.add("DPR")
+			// The DPR comes from a client hint rather than the caller, so
+			// it is silently skipped when the allowlist excludes it.
+			if optionAllowed(cfg, "dpr") {
+				dpr = getDPR(r)
+			}
+			if dpr != "" {
+				opts = append(opts, fmt.Sprintf("dpr:%s", dpr))
+			}
+		}
+		// autoquality needs a resizer build that supports it, so the param
+		// is ignored unless AUTO_QUALITY is enabled.
+		if cfg.autoQuality != "" && q.Get("aq") == "1" {
+			opts = append(opts, fmt.Sprintf("aq:%s", cfg.autoQuality))
+		}
+		// Unknown algorithms fall back to the resizer default.
+		if ra := q.Get("ra"); slices.Contains(resizingAlgorithms, ra) {
+			opts = append(opts, fmt.Sprintf("ra:%s", ra))
+		}
+		if q.Has("fpx") || q.Has("fpy") {
+			gravity, err := focusPoint(q.Get("fpx"), q.Get("fpy"))
+			if err != nil {
+				return target{}, err
+			}
+			opts = append(opts, gravity)
+		}
+		if value := q.Get("maxbytes"); value != "" {
+			maxBytes, err := strconv.Atoi(value)
+			if err != nil || maxBytes <= 0 {
+				return target{}, fmt.Errorf("maxbytes must be a positive integer")
+			}
+			opts = append(opts, fmt.Sprintf("mb:%d", maxBytes))
 		}
-		if height != "" && width == "" {
-			comp = fmt.Sprintf("h:%s", height)
+		// The resizer keeps the source format, so lossless output is only
+		// possible for WebP sources.
+		if q.Get("lossless") == "1" {
+			if !strings.EqualFold(fileExtension(urlPath), ".webp") {
+				return target{}, fmt.Errorf("lossless is only supported for WebP output")
+			}
+			opts = append(opts, "webpo:lossless")
 		}
-		if width != "" && height != "" {
-			comp = fmt.Sprintf("w:%s/h:%s", width, height)
+		for _, opt := range opts {
+			name, _, _ := strings.Cut(opt, ":")
+			if !optionAllowed(cfg, name) {
+				return target{}, fmt.Errorf("processing option %s is not allowed", name)
+			}
 		}
-		if comp != "" {
-			u.Path = fmt.Sprintf("/insecure/%s/plain/%s", comp, urlPath)
+		if len(opts) > cfg.maxResizeOptions {
+			return target{}, fmt.Errorf("too many processing options: %d, at most %d allowed", len(opts), cfg.maxResizeOptions)
+		}
+		// Rotating the pixels per EXIF and then dropping the metadata leaves
+		// no orientation flag for consumers to apply a second time. These
+		// are operator settings, so the allowlist and cap do not apply.
+		if cfg.normalizeOrientation {
+			opts = append(opts, "ar:1", "sm:1")
+		}
+		if len(opts) > 0 {
+			u.Path = fmt.Sprintf("/insecure/%s/plain/%s", strings.Join(opts, "/"), urlPath)
 		} else {
 			u.Path = fmt.Sprintf("/insecure/plain/%s", urlPath)
 		}
-		return u.String()
+		return target{
+			url:     u.String(),
+			dpr:     dpr,
+			vary:    vary,
+			resized: true,
+			backend: backendResizer,
+
+			sourceURL:     urlPath,
+			sourceBackend: backend,
+		}, nil
 	}
 
-	return urlPath
+	return target{url: urlPath, backend: backend, sourceURL: urlPath, sourceBackend: backend}, nil
+}
+
+// optionAllowed reports whether a resizer option, by its short name, may
+// be used. An empty allowlist permits every option.
+func optionAllowed(cfg *config, name string) bool {
+	return len(cfg.allowedResizeOptions) == 0 || slices.Contains(cfg.allowedResizeOptions, name)
+}
+
+// focusPoint returns the focus-point gravity option for fractional
+// coordinates, both of which must be within [0, 1].
+func focusPoint(fpx, fpy string) (string, error) {
+	x, errX := strconv.ParseFloat(fpx, 64)
+	y, errY := strconv.ParseFloat(fpy, 64)
+	if errX != nil || errY != nil || !(x >= 0 && x <= 1) || !(y >= 0 && y <= 1) {
+		return "", fmt.Errorf("fpx and fpy must both be between 0 and 1")
+	}
+	return fmt.Sprintf("g:fp:%s:%s", strconv.FormatFloat(x, 'f', -1, 64), strconv.FormatFloat(y, 'f', -1, 64)), nil
 }
 
-func fetchAsset(fullURL string) (*http.Response, error) {
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Get(fullURL)
+// dprHeader returns the name of the DPR client hint the request carries,
+// preferring the standardized Sec-CH-DPR over the legacy DPR header.
+func dprHeader(r *http.Request) string {
+	if r.Header.Get("Sec-CH-DPR") != "" {
+		return "Sec-CH-DPR"
+	}
+	return "DPR"
+}
+
+// wantsResize reports whether the request should go through the resizer.
+// Cache-Control: no-transform asks for the source byte for byte, so it
+// bypasses the resizer entirely.
+func wantsResize(r *http.Request) bool {
+	return r.URL.Query().Get("type") == "image" && !hasCacheDirective(r.Header, "no-transform")
+}
+
+// isResizable reports whether a source of the given media type can be sent
+// to the resizer. Sources whose type cannot be told from the extension are
+// passed through and left for the resizer to judge.
+func isResizable(cfg *config, mediaType string) bool {
+	if mediaType == defaultMediaType {
+		return true
+	}
+	base, _, err := mime.ParseMediaType(mediaType)
 	if err != nil {
-		return nil, err
+		return false
 	}
+	for _, t := range cfg.resizableTypes {
+		if strings.EqualFold(t, base) {
+			return true
+		}
+	}
+	return false
+}
+
+// getDPR returns the device pixel ratio from the DPR client hint, capped at
+// maxDPR. It returns an empty string when the hint is absent or invalid.
+func getDPR(r *http.Request) string {
+	value := r.Header.Get(dprHeader(r))
+	if value == "" {
+		return ""
+	}
+	dpr, err := strconv.ParseFloat(value, 64)
+	if err != nil || !(dpr > 0) {
+		return ""
+	}
+	if dpr > maxDPR {
+		dpr = maxDPR
+	}
+	return strconv.FormatFloat(dpr, 'f', -1, 64)
+}
+
+// assetInfo is what a HEAD request reveals about an asset.
+type assetInfo struct {
+	size      int64  // Content-Length, or -1 when it is not declared
+	validator string // ETag, else Last-Modified, else empty
+}
+
+// headAsset describes an asset as its backend reports it without fetching
+// its body.
+func headAsset(ctx context.Context, fullURL, backend string, header http.Header) (assetInfo, error) {
+	ctx, stop, err := attemptContext(ctx)
+	if err != nil {
+		return assetInfo{}, err
+	}
+	defer stop()
+	req, err := http.NewRequestWithContext(withConnTrace(ctx, backend), http.MethodHead, fullURL, nil)
+	if err != nil {
+		return assetInfo{}, err
+	}
+	if host := header.Get("Host"); host != "" {
+		req.Host = host
+		header.Del("Host")
+	}
+	req.Header = header
+	release, err := fetchLimiter.acquire(ctx, req.URL.Host)
+	if err != nil {
+		return assetInfo{}, err
+	}
+	defer release()
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return assetInfo{}, err
+	}
+	resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
+		return assetInfo{}, &statusError{code: resp.StatusCode}
+	}
+	return assetInfo{size: resp.ContentLength, validator: validator(resp.Header)}, nil
+}
+
+// validator is the ETag of a response, else its Last-Modified, else empty.
+func validator(header http.Header) string {
+	if etag := header.Get("ETag"); etag != "" {
+		return etag
+	}
+	return header.Get("Last-Modified")
+}
+
+// statusError reports an unexpected status code from a backend.
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status code: %d", e.code)
+}
+
+// upstreamHeaders returns the client request headers forwarded to the
+// backend along with the request ID and the static headers configured for
+// that backend. The static headers, which may hold a Host override and
+// credentials, only go to the configured asset host: fallback and override
+// hosts are other servers. Range requests are passed through untouched, including
+// multi-range requests whose multipart/byteranges response is streamed
+// back as is; resized output has a different byte layout, so ranges are
+// never forwarded to the resizer.
+func upstreamHeaders(r *http.Request, cfg *config, t target) http.Header {
+	h := http.Header{}
+	if t.backend != backendAssets || strings.HasPrefix(t.url, cfg.assetsApiHost+"/") {
+		for name, values := range cfg.backendHeaders[t.backend] {
+			h[name] = append([]string(nil), values...)
+		}
+	}
+	if id := middleware.GetReqID(r.Context()); id != "" {
+		for _, name := range cfg.requestIDHeaders {
+			h.Set(name, id)
+		}
+	}
+	setTraceHeaders(h, r)
+	// Processed bodies are always fetched whole; see transformable.
+	if !t.resized && (!transformable(cfg, getContentTypeFromFilename(t.url)) || hasCacheDirective(r.Header, "no-transform")) {
+		for _, name := range []string{"Range", "If-Range"} {
+			if value := r.Header.Get(name); value != "" {
+				h.Set(name, value)
+			}
+		}
+	}
+	return h
+}
+
+// httpClient is shared by all backend requests so connections are pooled.
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+func newHTTPClient(cfg *config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = cfg.maxIdleConnsPerHost
+	return &http.Client{Timeout: 10 * time.Second, Transport: clientCertTransport(cfg, transport)}
+}
+
+func fetchAsset(ctx context.Context, fullURL, backend string, header http.Header) (*http.Response, error) {
+	ctx, stop, err := attemptContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stop()
+	req, err := http.NewRequestWithContext(withConnTrace(ctx, backend), http.MethodGet, fullURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	// A configured Host header has to go through req.Host to take effect.
+	if host := header.Get("Host"); host != "" {
+		req.Host = host
+		header.Del("Host")
+	}
+	req.Header = header
+	release, err := fetchLimiter.acquire(ctx, req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = releasingBody{resp.Body, release}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
 		resp.Body.Close()
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return nil, &statusError{code: resp.StatusCode}
 	}
 	return resp, nil
 }
 
-func setResponseHeaders(w http.ResponseWriter, resp *http.Response, mediaType string) {
+func setResponseHeaders(w http.ResponseWriter, resp *http.Response, cfg *config, mediaType, cacheControl string) {
 	if contentDisposition := resp.Header.Get("Content-Disposition"); contentDisposition != "" {
 		w.Header().Set("Content-Disposition", contentDisposition)
 	}
@@ -168,18 +993,169 @@ func setResponseHeaders(w http.ResponseWriter, resp *http.Response, mediaType st
 		contentType = mediaType
 	}
 	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Content-Length", resp.Header.Get("Content-Length"))
-	w.Header().Set("Cache-Control", cacheMaxAge)
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	// When the transport transparently gunzipped the body, a backend-sent
+	// Content-Length is the compressed size and the encoding no longer
+	// applies. Only a length measured while buffering can be trusted.
+	contentLength := resp.Header.Get("Content-Length")
+	if resp.Uncompressed {
+		w.Header().Del("Content-Encoding")
+		if resp.ContentLength < 0 {
+			contentLength = ""
+		}
+	}
+	if contentLength != "" {
+		w.Header().Set("Content-Length", contentLength)
+	}
+	for _, name := range []string{"Content-Range", "Accept-Ranges"} {
+		if value := resp.Header.Get(name); value != "" {
+			w.Header().Set(name, value)
+		}
+	}
+	// The proxy keeps no cache of its own, so a backend's immutable,
+	// whether signalled by IMMUTABLE_HEADER or in its Cache-Control, is
+	// passed on for downstream caches to skip revalidation.
+	immutable, _ := strconv.ParseBool(resp.Header.Get(cfg.immutableHeader))
+	if (immutable || hasCacheDirective(resp.Header, "immutable")) && cacheControl != cacheNoStore {
+		cacheControl += ", immutable"
+	}
+	// Keep downstream caches from transforming what the backend marked
+	// as no-transform.
+	if hasCacheDirective(resp.Header, "no-transform") {
+		cacheControl += ", no-transform"
+	}
+	w.Header().Set("Cache-Control", cacheControl)
+	setCrossOriginHeaders(w.Header(), cfg)
+	setHardeningHeaders(w.Header(), cfg, contentType)
 }
 
-func getContentTypeFromFilename(urlPath string) string {
+// setCrossOriginHeaders lets pages on any origin load a response, subject
+// to CROSS_ORIGIN_RESOURCE_POLICY.
+func setCrossOriginHeaders(h http.Header, cfg *config) {
+	h.Set("Access-Control-Allow-Origin", "*")
+	h.Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	h.Set("Cross-Origin-Resource-Policy", cfg.resourcePolicy)
+}
+
+// canonicalURL is the address of the unprocessed asset: the request URL
+// without its query string.
+func canonicalURL(r *http.Request) string {
+	u := url.URL{Scheme: requestScheme(r), Host: r.Host, Path: r.URL.Path, RawPath: r.URL.RawPath}
+	return u.String()
+}
+
+// setImageDimensions reports the output size of a resized image: the
+// resizer's X-Result-Width/X-Result-Height debug headers, or else the size
+// decoded from a body held in memory. The requested dimensions are not a
+// substitute, since fitting and cropping can change them, so nothing is
+// reported when neither is available.
+func setImageDimensions(w http.ResponseWriter, resp *http.Response, buffered bool) {
+	width := resp.Header.Get("X-Result-Width")
+	height := resp.Header.Get("X-Result-Height")
+	if width == "" && height == "" && buffered {
+		body, err := io.ReadAll(resp.Body)
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		if err == nil {
+			if img, _, err := image.DecodeConfig(bytes.NewReader(body)); err == nil {
+				width, height = strconv.Itoa(img.Width), strconv.Itoa(img.Height)
+			}
+		}
+	}
+	if width != "" {
+		w.Header().Set("X-Image-Width", width)
+	}
+	if height != "" {
+		w.Header().Set("X-Image-Height", height)
+	}
+}
+
+// hasCacheDirective reports whether the Cache-Control header carries the
+// given directive.
+func hasCacheDirective(h http.Header, directive string) bool {
+	for _, value := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(value, ",") {
+			name, _, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if strings.EqualFold(name, directive) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cacheControlFor returns the Cache-Control for an asset. Paths under
+// NO_STORE_PREFIXES must never be stored by any cache; otherwise the TTL
+// configured for its extension is used when there is one.
+func cacheControlFor(cfg *config, urlPath string) string {
+	for _, prefix := range cfg.noStorePrefixes {
+		if strings.HasPrefix(urlPath, prefix) {
+			return cacheNoStore
+		}
+	}
+	if ttl, ok := cfg.extensionTTLs[strings.ToLower(fileExtension(urlPath))]; ok {
+		return fmt.Sprintf("max-age=%d, public", int(ttl.Seconds()))
+	}
+	return cacheMaxAge
+}
+
+// fileExtension returns the extension of the last path segment, ignoring
+// any query string of an absolute source URL and a .br compression suffix,
+// so style.css.br yields .css.
+func fileExtension(urlPath string) string {
 	_, filename := filepath.Split(urlPath)
 
 	filename = strings.Split(filename, "?")[0]
+	if hasCompressionSuffix(filename) {
+		filename = filename[:len(filename)-len(".br")]
+	}
 
-	mimeType := mime.TypeByExtension(filepath.Ext(filename))
+	return filepath.Ext(filename)
+}
+
+func hasCompressionSuffix(urlPath string) bool {
+	return strings.HasSuffix(strings.ToLower(strings.Split(urlPath, "?")[0]), ".br")
+}
+
+// extensionTypes pins the content types of common web assets, which the
+// OS mime database may lack or disagree on between platforms. Entries from
+// CONTENT_TYPES are merged in at startup and take precedence.
+var extensionTypes = map[string]string{
+	".avif":        "image/avif",
+	".css":         "text/css; charset=utf-8",
+	".gif":         "image/gif",
+	".heic":        "image/heic",
+	".heif":        "image/heif",
+	".html":        "text/html; charset=utf-8",
+	".ico":         "image/x-icon",
+	".jpeg":        "image/jpeg",
+	".jpg":         "image/jpeg",
+	".js":          "text/javascript; charset=utf-8",
+	".json":        "application/json",
+	".jxl":         "image/jxl",
+	".m4a":         "audio/mp4",
+	".mjs":         "text/javascript; charset=utf-8",
+	".mp3":         "audio/mpeg",
+	".mp4":         "video/mp4",
+	".otf":         "font/otf",
+	".pdf":         "application/pdf",
+	".png":         "image/png",
+	".svg":         "image/svg+xml",
+	".ttf":         "font/ttf",
+	".txt":         "text/plain; charset=utf-8",
+	".wasm":        "application/wasm",
+	".webm":        "video/webm",
+	".webmanifest": "application/manifest+json",
+	".webp":        "image/webp",
+	".woff":        "font/woff",
+	".woff2":       "font/woff2",
+	".xml":         "text/xml; charset=utf-8",
+}
+
+func getContentTypeFromFilename(urlPath string) string {
+	ext := strings.ToLower(fileExtension(urlPath))
+	if mimeType, ok := extensionTypes[ext]; ok {
+		return mimeType
+	}
+	mimeType := mime.TypeByExtension(ext)
 	if mimeType == "" {
 		mimeType = defaultMediaType
 	}
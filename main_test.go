@@ -0,0 +1,1442 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// testConfig loads the configuration the way main does, with both backends
+// pointing at backend and env applied on top, and sets up the package
+// state main derives from it.
+func testConfig(t *testing.T, backend string, env map[string]string) *config {
+	t.Helper()
+	t.Setenv("ASSETS_API_HOST", backend)
+	t.Setenv("RESIZER_API_HOST", backend)
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+	cfg := loadConfig()
+
+	types := maps.Clone(extensionTypes)
+	t.Cleanup(func() { extensionTypes = types })
+	gzipLevel = cfg.gzipLevel
+	gzipMinSize = cfg.gzipMinSize
+	httpClient = newHTTPClient(cfg)
+	maps.Copy(extensionTypes, cfg.contentTypes)
+	blurhashes.Store(newBlurhashCache(cfg.blurhashCacheSize))
+	fetchLimiter = nil
+	if cfg.maxFetchesPerHost > 0 {
+		fetchLimiter = newHostLimiter(cfg.maxFetchesPerHost, cfg.fetchQueueTimeout)
+	}
+	return cfg
+}
+
+// newBackend starts a backend serving handler for the duration of the test.
+func newBackend(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// routes registers the asset routes the way main does.
+func routes(cfg *config, errs *errorLog) http.Handler {
+	r := chi.NewRouter()
+	r.Use(middleware.RequestID)
+	r.Get("/assets/*", assetsHandler(cfg, errs))
+	r.Get("/sprite", spriteHandler(cfg))
+	r.Get("/manifest/*", manifestHandler(cfg))
+	return r
+}
+
+// serve sends req through the routes main registers for assets.
+func serve(cfg *config, errs *errorLog, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	routes(cfg, errs).ServeHTTP(rec, req)
+	return rec
+}
+
+// resizerBackend answers asset requests with their path and resizer
+// requests, under /insecure/, with a PNG type, recording the last path the
+// resizer was asked for.
+func resizerBackend(t *testing.T, resized *string) *httptest.Server {
+	return newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/insecure/") {
+			*resized = r.URL.Path
+			w.Header().Set("Content-Type", "image/png")
+		}
+		w.Write([]byte(r.URL.Path))
+	})
+}
+
+func TestContentDPR(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		header  map[string]string
+		wantDPR string
+		wantOpt string
+	}{
+		{"hint applied", "type=image&w=100", map[string]string{"DPR": "2"}, "2", "/dpr:2/"},
+		{"standard hint preferred", "type=image&h=50", map[string]string{"Sec-CH-DPR": "3", "DPR": "2"}, "3", "/dpr:3/"},
+		{"capped", "type=image&w=100", map[string]string{"DPR": "9"}, "5", "/dpr:5/"},
+		{"fractional", "type=image&w=100", map[string]string{"DPR": "1.5"}, "1.5", "/dpr:1.5/"},
+		{"no dimensions", "type=image", map[string]string{"DPR": "2"}, "", ""},
+		{"invalid hint", "type=image&w=100", map[string]string{"DPR": "abc"}, "", ""},
+		{"negative hint", "type=image&w=100", map[string]string{"DPR": "-1"}, "", ""},
+		{"no hint", "type=image&w=100", nil, "", ""},
+		{"not resized", "w=100", map[string]string{"DPR": "2"}, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resized string
+			backend := resizerBackend(t, &resized)
+			cfg := testConfig(t, backend.URL, nil)
+
+			req := httptest.NewRequest(http.MethodGet, "/assets/photo.png?"+tt.query, nil)
+			for name, value := range tt.header {
+				req.Header.Set(name, value)
+			}
+			rec := serve(cfg, nil, req)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", rec.Code)
+			}
+			if got := rec.Header().Get("Content-DPR"); got != tt.wantDPR {
+				t.Errorf("Content-DPR = %q, want %q", got, tt.wantDPR)
+			}
+			if tt.wantOpt != "" && !strings.Contains(resized, tt.wantOpt) {
+				t.Errorf("resizer path %q does not contain %q", resized, tt.wantOpt)
+			}
+			if tt.wantOpt == "" && strings.Contains(resized, "dpr:") {
+				t.Errorf("resizer path %q has a dpr option", resized)
+			}
+		})
+	}
+}
+
+func TestDuplicateParams(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        map[string]string
+		path       string
+		wantStatus int
+		wantOpt    string
+		wantDup    string // parameter named in the 400
+	}{
+		{"first wins", nil, "/assets/photo.png?type=image&w=100&w=200", http.StatusOK, "/w:100/", ""},
+		{"first wins across case", map[string]string{"CASE_INSENSITIVE_PARAMS": "true"}, "/assets/photo.png?type=image&W=100&w=200", http.StatusOK, "/w:100/", ""},
+		{"rejected", map[string]string{"DUPLICATE_PARAMS": duplicateParamsReject}, "/assets/photo.png?type=image&w=100&w=200", http.StatusBadRequest, "", "w"},
+		{"rejected across case", map[string]string{"DUPLICATE_PARAMS": duplicateParamsReject, "CASE_INSENSITIVE_PARAMS": "true"}, "/assets/photo.png?type=image&w=100&W=200", http.StatusBadRequest, "", "w"},
+		{"single values", map[string]string{"DUPLICATE_PARAMS": duplicateParamsReject}, "/assets/photo.png?type=image&w=100&h=50", http.StatusOK, "/w:100/h:50/", ""},
+		{"unknown repeated", map[string]string{"DUPLICATE_PARAMS": duplicateParamsReject}, "/assets/photo.png?type=image&w=100&v=1&v=2", http.StatusOK, "/w:100/", ""},
+		{"sprite rejected", map[string]string{"DUPLICATE_PARAMS": duplicateParamsReject}, "/sprite?icons=a.png&icons=b.png", http.StatusBadRequest, "", "icons"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resized string
+			backend := resizerBackend(t, &resized)
+			cfg := testConfig(t, backend.URL, tt.env)
+
+			rec := serve(cfg, nil, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantDup != "" && !strings.Contains(rec.Body.String(), "duplicate query parameter: "+tt.wantDup) {
+				t.Errorf("body = %q, want %s named", rec.Body.String(), tt.wantDup)
+			}
+			if !strings.Contains(resized, tt.wantOpt) {
+				t.Errorf("resizer path %q does not contain %q", resized, tt.wantOpt)
+			}
+		})
+	}
+}
+
+func TestImmutableHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		header map[string]string
+		want   string
+	}{
+		{"default header", nil, map[string]string{"X-Immutable": "true"}, cacheMaxAge + ", immutable"},
+		{"false", nil, map[string]string{"X-Immutable": "false"}, cacheMaxAge},
+		{"invalid", nil, map[string]string{"X-Immutable": "yes please"}, cacheMaxAge},
+		{"absent", nil, nil, cacheMaxAge},
+		{"custom header", map[string]string{"IMMUTABLE_HEADER": "X-Asset-Immutable"}, map[string]string{"X-Asset-Immutable": "1"}, cacheMaxAge + ", immutable"},
+		{"default ignored when renamed", map[string]string{"IMMUTABLE_HEADER": "X-Asset-Immutable"}, map[string]string{"X-Immutable": "true"}, cacheMaxAge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				for name, value := range tt.header {
+					w.Header().Set(name, value)
+				}
+				w.Write([]byte("body"))
+			})
+			cfg := testConfig(t, backend.URL, tt.env)
+
+			rec := serve(cfg, nil, httptest.NewRequest(http.MethodGet, "/assets/a.txt", nil))
+
+			if got := rec.Header().Get("Cache-Control"); got != tt.want {
+				t.Errorf("Cache-Control = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackendImmutable(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		path   string
+		header map[string]string
+		want   string
+	}{
+		{"directive", nil, "a.txt", map[string]string{"Cache-Control": "public, max-age=31536000, immutable"}, cacheMaxAge + ", immutable"},
+		{"directive case", nil, "a.txt", map[string]string{"Cache-Control": "Immutable"}, cacheMaxAge + ", immutable"},
+		{"directive and header", nil, "a.txt", map[string]string{"Cache-Control": "immutable", "X-Immutable": "true"}, cacheMaxAge + ", immutable"},
+		{"no directive", nil, "a.txt", map[string]string{"Cache-Control": "max-age=60"}, cacheMaxAge},
+		{"no-store path", map[string]string{"NO_STORE_PREFIXES": "private/"}, "private/a.txt", map[string]string{"Cache-Control": "immutable"}, cacheNoStore},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				for name, value := range tt.header {
+					w.Header().Set(name, value)
+				}
+				w.Write([]byte("body"))
+			})
+			cfg := testConfig(t, backend.URL, tt.env)
+
+			rec := serve(cfg, nil, httptest.NewRequest(http.MethodGet, "/assets/"+tt.path, nil))
+
+			if got := rec.Header().Get("Cache-Control"); got != tt.want {
+				t.Errorf("Cache-Control = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResizableTypes(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		path  string
+		query string
+		want  int
+	}{
+		{"image", nil, "photo.jpg", "type=image&w=10", http.StatusOK},
+		{"text", nil, "notes.txt", "type=image&w=10", http.StatusUnsupportedMediaType},
+		{"pdf", nil, "doc.pdf", "type=image", http.StatusUnsupportedMediaType},
+		{"unknown extension", nil, "blob", "type=image&w=10", http.StatusOK},
+		{"text without resize", nil, "notes.txt", "w=10", http.StatusOK},
+		{"narrowed list", map[string]string{"RESIZABLE_TYPES": "image/png"}, "photo.jpg", "type=image&w=10", http.StatusUnsupportedMediaType},
+		{"narrowed list match", map[string]string{"RESIZABLE_TYPES": "image/png"}, "photo.png", "type=image&w=10", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resized string
+			backend := resizerBackend(t, &resized)
+			cfg := testConfig(t, backend.URL, tt.env)
+
+			rec := serve(cfg, nil, httptest.NewRequest(http.MethodGet, "/assets/"+tt.path+"?"+tt.query, nil))
+
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if tt.want == http.StatusUnsupportedMediaType && resized != "" {
+				t.Errorf("resizer was called for %s", resized)
+			}
+		})
+	}
+}
+
+func TestVary(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		path   string
+		header map[string]string
+		want   string
+	}{
+		{"plain asset", nil, "a.txt", nil, ""},
+		{"resize without dimensions", nil, "a.png?type=image", nil, ""},
+		{"resize with width", nil, "a.png?type=image&w=100", nil, "Sec-Ch-Dpr, Dpr"},
+		{"resize with width and hint", nil, "a.png?type=image&w=100", map[string]string{"DPR": "2"}, "Sec-Ch-Dpr, Dpr"},
+		{"hotlink protected image", map[string]string{"HOTLINK_ALLOWED_HOSTS": "example.com"}, "a.png", nil, "Referer, Origin"},
+		{"hotlink protection skips text", map[string]string{"HOTLINK_ALLOWED_HOSTS": "example.com"}, "a.txt", nil, ""},
+		{"resize and hotlink", map[string]string{"HOTLINK_ALLOWED_HOSTS": "example.com"}, "a.png?type=image&h=10", nil, "Sec-Ch-Dpr, Dpr, Referer, Origin"},
+		{"precompressed", map[string]string{"PRECOMPRESSED": "true"}, "a.txt", nil, "Accept-Encoding"},
+		{"compressed type", map[string]string{"COMPRESS_TYPES": "text/"}, "a.txt", nil, "Accept-Encoding"},
+		{"uncompressed type", map[string]string{"COMPRESS_TYPES": "application/json"}, "a.txt", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, ".br") {
+					http.NotFound(w, r)
+					return
+				}
+				w.Write([]byte(strings.Repeat("x", 2000)))
+			})
+			cfg := testConfig(t, backend.URL, tt.env)
+
+			req := httptest.NewRequest(http.MethodGet, "/assets/"+tt.path, nil)
+			for name, value := range tt.header {
+				req.Header.Set(name, value)
+			}
+			rec := serve(cfg, nil, req)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", rec.Code)
+			}
+			if got := rec.Header().Get("Vary"); got != tt.want {
+				t.Errorf("Vary = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVarySet(t *testing.T) {
+	tests := []struct {
+		name  string
+		added []string
+		want  string
+	}{
+		{"empty", nil, ""},
+		{"canonicalized", []string{"accept-encoding"}, "Accept-Encoding"},
+		{"deduplicated", []string{"DPR", "dpr", "Referer", "DPR"}, "Dpr, Referer"},
+		{"order kept", []string{"Origin", "Referer"}, "Origin, Referer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v varySet
+			for _, name := range tt.added {
+				v.add(name)
+			}
+			h := http.Header{}
+			v.apply(h)
+			if got := h.Get("Vary"); got != tt.want {
+				t.Errorf("Vary = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRangePassthrough(t *testing.T) {
+	content := "0123456789abcdefghijklmnopqrstuvwxyz"
+	tests := []struct {
+		name            string
+		path            string
+		rangeHeader     string
+		wantStatus      int
+		wantBody        string // checked when not empty
+		wantContentType string // prefix
+		wantRange       string // Range seen by the backend
+	}{
+		{"whole", "data.bin", "", http.StatusOK, content, "application/octet-stream", ""},
+		{"single range", "data.bin", "bytes=0-3", http.StatusPartialContent, "0123", "application/octet-stream", "bytes=0-3"},
+		{"suffix range", "data.bin", "bytes=-3", http.StatusPartialContent, "xyz", "application/octet-stream", "bytes=-3"},
+		{"multipart", "data.bin", "bytes=0-1,10-11", http.StatusPartialContent, "", "multipart/byteranges; boundary=", "bytes=0-1,10-11"},
+		{"unsatisfiable", "data.bin", "bytes=100-200", http.StatusRequestedRangeNotSatisfiable, "", "application/json", "bytes=100-200"},
+		{"resized", "photo.png?type=image&w=10", "bytes=0-3", http.StatusOK, "", "image/png", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var backendBody, gotRange string
+			backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodGet {
+					gotRange = r.Header.Get("Range")
+				}
+				rec := httptest.NewRecorder()
+				rec.Header().Set("Content-Type", "application/octet-stream")
+				if strings.HasPrefix(r.URL.Path, "/insecure/") {
+					rec.Header().Set("Content-Type", "image/png")
+				}
+				http.ServeContent(rec, r, "data", time.Time{}, strings.NewReader(content))
+				backendBody = rec.Body.String()
+				for name, values := range rec.Header() {
+					w.Header()[name] = values
+				}
+				w.WriteHeader(rec.Code)
+				w.Write(rec.Body.Bytes())
+			})
+			cfg := testConfig(t, backend.URL, nil)
+
+			req := httptest.NewRequest(http.MethodGet, "/assets/"+tt.path, nil)
+			if tt.rangeHeader != "" {
+				req.Header.Set("Range", tt.rangeHeader)
+			}
+			rec := serve(cfg, nil, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, tt.wantContentType) {
+				t.Errorf("Content-Type = %q, want prefix %q", got, tt.wantContentType)
+			}
+			if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rec.Body.String(), tt.wantBody)
+			}
+			if gotRange != tt.wantRange {
+				t.Errorf("backend saw Range %q, want %q", gotRange, tt.wantRange)
+			}
+			if tt.wantStatus == http.StatusPartialContent {
+				if rec.Body.String() != backendBody {
+					t.Errorf("body = %q, want the backend's %q", rec.Body.String(), backendBody)
+				}
+				single := !strings.HasPrefix(tt.wantContentType, "multipart/")
+				if got := rec.Header().Get("Content-Range"); single && got == "" {
+					t.Error("Content-Range missing")
+				}
+			}
+		})
+	}
+}
+
+func TestIfRangeForwarded(t *testing.T) {
+	var got string
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("If-Range")
+	})
+	cfg := testConfig(t, backend.URL, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/assets/data.bin", nil)
+	req.Header.Set("Range", "bytes=0-1")
+	req.Header.Set("If-Range", `"v1"`)
+	serve(cfg, nil, req)
+
+	if got != `"v1"` {
+		t.Errorf("backend saw If-Range %q, want %q", got, `"v1"`)
+	}
+}
+
+func TestRequestIDForwarded(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		query string
+		want  []string
+	}{
+		{"default header", nil, "", []string{"X-Request-Id"}},
+		{"configured headers", map[string]string{"REQUEST_ID_HEADERS": "X-Correlation-ID, X-Trace-Id"}, "", []string{"X-Correlation-Id", "X-Trace-Id"}},
+		{"to the resizer", nil, "?type=image&w=10", []string{"X-Request-Id"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got http.Header
+			backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodGet {
+					got = r.Header.Clone()
+				}
+			})
+			cfg := testConfig(t, backend.URL, tt.env)
+
+			req := httptest.NewRequest(http.MethodGet, "/assets/photo.png"+tt.query, nil)
+			req.Header.Set(middleware.RequestIDHeader, "req-42")
+			serve(cfg, nil, req)
+
+			for _, name := range tt.want {
+				if value := got.Get(name); value != "req-42" {
+					t.Errorf("backend saw %s = %q, want %q", name, value, "req-42")
+				}
+			}
+		})
+	}
+}
+
+func TestBackendHeaders(t *testing.T) {
+	env := map[string]string{
+		"ASSETS_API_HEADERS":  "Authorization: Bearer assets; Host: assets.internal",
+		"RESIZER_API_HEADERS": "X-Resizer-Key: k1",
+	}
+	tests := []struct {
+		name     string
+		path     string
+		external bool
+		wantAuth string
+		wantKey  string
+		wantHost string // empty for the backend's own address
+	}{
+		{"asset", "a.txt", false, "Bearer assets", "", "assets.internal"},
+		{"resized", "a.png?type=image&w=10", false, "", "k1", ""},
+		{"external", "a.txt", true, "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *http.Request
+			handler := func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodGet {
+					got = r
+				}
+			}
+			backend := newBackend(t, handler)
+			external := newBackend(t, handler)
+			cfg := testConfig(t, backend.URL, env)
+
+			path := tt.path
+			if tt.external {
+				path = url.QueryEscape(external.URL + "/" + path)
+			}
+			serve(cfg, nil, httptest.NewRequest(http.MethodGet, "/assets/"+path, nil))
+
+			if got == nil {
+				t.Fatal("no backend request")
+			}
+			if value := got.Header.Get("Authorization"); value != tt.wantAuth {
+				t.Errorf("Authorization = %q, want %q", value, tt.wantAuth)
+			}
+			if value := got.Header.Get("X-Resizer-Key"); value != tt.wantKey {
+				t.Errorf("X-Resizer-Key = %q, want %q", value, tt.wantKey)
+			}
+			wantHost := tt.wantHost
+			if wantHost == "" {
+				wantHost = strings.TrimPrefix(backend.URL, "http://")
+				if tt.external {
+					wantHost = strings.TrimPrefix(external.URL, "http://")
+				}
+			}
+			if got.Host != wantHost {
+				t.Errorf("Host = %q, want %q", got.Host, wantHost)
+			}
+			if got.Header.Get("Host") != "" {
+				t.Error("Host sent as a header field")
+			}
+		})
+	}
+}
+
+// resize requests the asset at path through the proxy and returns the
+// response along with the path the resizer was asked for, if any.
+func resize(t *testing.T, env map[string]string, path string) (*httptest.ResponseRecorder, string) {
+	t.Helper()
+	var resized string
+	backend := resizerBackend(t, &resized)
+	cfg := testConfig(t, backend.URL, env)
+	rec := serve(cfg, nil, httptest.NewRequest(http.MethodGet, "/assets/"+path, nil))
+	return rec, resized
+}
+
+func TestAutoQuality(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		query string
+		want  string
+	}{
+		{"enabled", map[string]string{"AUTO_QUALITY": "dssim"}, "type=image&w=10&aq=1", "/insecure/w:10/aq:dssim/plain/"},
+		{"enabled without dimensions", map[string]string{"AUTO_QUALITY": "ml"}, "type=image&aq=1", "/insecure/aq:ml/plain/"},
+		{"not requested", map[string]string{"AUTO_QUALITY": "dssim"}, "type=image&w=10", "/insecure/w:10/plain/"},
+		{"other value", map[string]string{"AUTO_QUALITY": "dssim"}, "type=image&w=10&aq=true", "/insecure/w:10/plain/"},
+		{"disabled", nil, "type=image&w=10&aq=1", "/insecure/w:10/plain/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, resized := resize(t, tt.env, "photo.png?"+tt.query)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", rec.Code)
+			}
+			if !strings.HasPrefix(resized, tt.want) {
+				t.Errorf("resizer path = %q, want prefix %q", resized, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerOptions(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		target    string
+		want      int
+		wantAllow string
+	}{
+		{"asterisk", http.MethodOptions, "*", http.StatusNoContent, "GET, OPTIONS"},
+		{"path", http.MethodOptions, "/assets/a.txt", http.StatusTeapot, ""},
+		{"get", http.MethodGet, "/assets/a.txt", http.StatusTeapot, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := serverOptions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusTeapot)
+			}))
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.target, nil))
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if got := rec.Header().Get("Allow"); got != tt.wantAllow {
+				t.Errorf("Allow = %q, want %q", got, tt.wantAllow)
+			}
+		})
+	}
+}
+
+func TestCanonicalHostRedirect(t *testing.T) {
+	tests := []struct {
+		name         string
+		target       string
+		host         string
+		proto        string
+		want         int
+		wantLocation string
+	}{
+		{"canonical", "/assets/a.txt", "cdn.example.com", "", http.StatusOK, ""},
+		{"case-insensitive", "/assets/a.txt", "CDN.example.com", "", http.StatusOK, ""},
+		{"other host", "/assets/a.txt?w=1", "old.example.com", "", http.StatusMovedPermanently, "http://cdn.example.com/assets/a.txt?w=1"},
+		{"behind tls proxy", "/assets/a.txt", "old.example.com", "https", http.StatusMovedPermanently, "https://cdn.example.com/assets/a.txt"},
+		{"debug endpoint", "/debug/errors", "10.0.0.1:8080", "", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := canonicalHostRedirect("cdn.example.com")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			req.Host = tt.host
+			if tt.proto != "" {
+				req.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if got := rec.Header().Get("Location"); got != tt.wantLocation {
+				t.Errorf("Location = %q, want %q", got, tt.wantLocation)
+			}
+		})
+	}
+}
+
+func TestMaxResizeOptions(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		query string
+		dpr   string
+		want  int
+	}{
+		{"under default cap", nil, "type=image&w=10&h=10&ra=cubic&maxbytes=1000", "", http.StatusOK},
+		{"at cap", map[string]string{"MAX_RESIZE_OPTIONS": "2"}, "type=image&w=10&h=10", "", http.StatusOK},
+		{"over cap", map[string]string{"MAX_RESIZE_OPTIONS": "2"}, "type=image&w=10&h=10&ra=cubic", "", http.StatusBadRequest},
+		{"hint counts", map[string]string{"MAX_RESIZE_OPTIONS": "2"}, "type=image&w=10&h=10", "2", http.StatusBadRequest},
+		{"zero", map[string]string{"MAX_RESIZE_OPTIONS": "0"}, "type=image", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resized string
+			backend := resizerBackend(t, &resized)
+			cfg := testConfig(t, backend.URL, tt.env)
+			req := httptest.NewRequest(http.MethodGet, "/assets/photo.png?"+tt.query, nil)
+			if tt.dpr != "" {
+				req.Header.Set("DPR", tt.dpr)
+			}
+			rec := serve(cfg, nil, req)
+
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if tt.want == http.StatusBadRequest {
+				if !strings.Contains(rec.Body.String(), "too many processing options") {
+					t.Errorf("body = %q", rec.Body)
+				}
+				if resized != "" {
+					t.Errorf("resizer called with %s", resized)
+				}
+			}
+		})
+	}
+}
+
+func TestProblemJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		accept   string
+		wantType string
+	}{
+		{"default", "", "application/json"},
+		{"json", "application/json", "application/json"},
+		{"problem", "application/problem+json", "application/problem+json"},
+		{"problem among others", "application/json, application/problem+json;q=0.9", "application/problem+json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/assets/missing.txt", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+			writeError(rec, req, http.StatusNotFound, "asset not found")
+
+			if got := rec.Header().Get("Content-Type"); got != tt.wantType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantType)
+			}
+			if !strings.Contains(rec.Header().Get("Vary"), "Accept") {
+				t.Errorf("Vary = %q, want Accept listed", rec.Header().Get("Vary"))
+			}
+			if tt.wantType == "application/json" {
+				var body map[string]string
+				if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body["error"] != "asset not found" {
+					t.Errorf("body = %q", rec.Body)
+				}
+				return
+			}
+			var got problem
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			want := problem{Type: "about:blank", Title: "Not Found", Status: http.StatusNotFound, Detail: "asset not found", Instance: "/assets/missing.txt"}
+			if got != want {
+				t.Errorf("problem = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestResizingAlgorithm(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"type=image&w=10&ra=lanczos3", "/insecure/w:10/ra:lanczos3/plain/"},
+		{"type=image&ra=nearest", "/insecure/ra:nearest/plain/"},
+		{"type=image&w=10&ra=bogus", "/insecure/w:10/plain/"},
+		{"type=image&w=10&ra=", "/insecure/w:10/plain/"},
+		{"type=image&w=10&ra=LANCZOS3", "/insecure/w:10/plain/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			rec, resized := resize(t, nil, "photo.png?"+tt.query)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", rec.Code)
+			}
+			if !strings.HasPrefix(resized, tt.want) {
+				t.Errorf("resizer path = %q, want prefix %q", resized, tt.want)
+			}
+		})
+	}
+}
+
+func TestImageDimensions(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		dpr        string
+		env        map[string]string
+		result     map[string]string // X-Result-* headers sent by the resizer
+		wantWidth  string
+		wantHeight string
+	}{
+		{"decoded from output", "type=image&w=100&h=50", "", nil, nil, "30", "20"},
+		{"not the dpr-scaled request", "type=image&w=100&h=50", "2", nil, nil, "30", "20"},
+		{"resizer reported", "type=image&w=100", "", nil, map[string]string{"X-Result-Width": "100", "X-Result-Height": "67"}, "100", "67"},
+		{"streamed output", "type=image&w=100&h=50", "", map[string]string{"BUFFER_CONTENT_TYPES": "text/"}, nil, "", ""},
+		{"not resized", "w=100", "", nil, nil, "", ""},
+	}
+	output := solidPNG(t, 30, 20, red)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasPrefix(r.URL.Path, "/insecure/") {
+					for name, value := range tt.result {
+						w.Header().Set(name, value)
+					}
+					w.Write(output)
+				}
+			})
+			cfg := testConfig(t, backend.URL, tt.env)
+			req := httptest.NewRequest(http.MethodGet, "/assets/photo.png?"+tt.query, nil)
+			if tt.dpr != "" {
+				req.Header.Set("DPR", tt.dpr)
+			}
+			rec := serve(cfg, nil, req)
+
+			if got := rec.Header().Get("X-Image-Width"); got != tt.wantWidth {
+				t.Errorf("X-Image-Width = %q, want %q", got, tt.wantWidth)
+			}
+			if got := rec.Header().Get("X-Image-Height"); got != tt.wantHeight {
+				t.Errorf("X-Image-Height = %q, want %q", got, tt.wantHeight)
+			}
+			if tt.wantWidth != "" && !bytes.Equal(rec.Body.Bytes(), output) {
+				t.Error("body changed by reading its dimensions")
+			}
+		})
+	}
+}
+
+func TestNoTransform(t *testing.T) {
+	tests := []struct {
+		name             string
+		requestCC        string
+		responseCC       string
+		wantResized      bool
+		wantCacheControl string
+	}{
+		{"resize", "", "", true, cacheMaxAge},
+		{"client no-transform", "no-transform", "", false, cacheMaxAge},
+		{"client directive list", "max-age=0, No-Transform", "", false, cacheMaxAge},
+		{"backend no-transform", "", "public, no-transform", true, cacheMaxAge + ", no-transform"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resized string
+			backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasPrefix(r.URL.Path, "/insecure/") {
+					resized = r.URL.Path
+				}
+				if tt.responseCC != "" {
+					w.Header().Set("Cache-Control", tt.responseCC)
+				}
+			})
+			cfg := testConfig(t, backend.URL, nil)
+			req := httptest.NewRequest(http.MethodGet, "/assets/photo.png?type=image&w=10", nil)
+			if tt.requestCC != "" {
+				req.Header.Set("Cache-Control", tt.requestCC)
+			}
+			rec := serve(cfg, nil, req)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", rec.Code)
+			}
+			if (resized != "") != tt.wantResized {
+				t.Errorf("resizer path = %q, want resized = %v", resized, tt.wantResized)
+			}
+			if got := rec.Header().Get("Cache-Control"); got != tt.wantCacheControl {
+				t.Errorf("Cache-Control = %q, want %q", got, tt.wantCacheControl)
+			}
+		})
+	}
+}
+
+func TestExtensionTTLs(t *testing.T) {
+	env := map[string]string{"EXTENSION_TTLS": "json=1m, .WOFF2=8760h, html=0s"}
+	tests := []struct {
+		path     string
+		external bool
+		want     string
+	}{
+		{"d.json", false, "max-age=60, public"},
+		{"f.woff2", false, "max-age=31536000, public"},
+		{"F.WOFF2", false, "max-age=31536000, public"},
+		{"p.html", false, "max-age=0, public"},
+		{"a.txt", false, cacheMaxAge},
+		{"d.json?v=1", true, "max-age=60, public"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+			cfg := testConfig(t, backend.URL, env)
+			path := tt.path
+			if tt.external {
+				path = url.QueryEscape(backend.URL + "/" + path)
+			}
+			rec := serve(cfg, nil, httptest.NewRequest(http.MethodGet, "/assets/"+path, nil))
+			if got := rec.Header().Get("Cache-Control"); got != tt.want {
+				t.Errorf("Cache-Control = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCanonicalLinks(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		target string
+		proto  string
+		want   string
+	}{
+		{"resized", map[string]string{"CANONICAL_LINKS": "true"}, "/assets/img/a.png?type=image&w=10", "", `<http://cdn.example.com/assets/img/a.png>; rel="canonical"`},
+		{"behind tls proxy", map[string]string{"CANONICAL_LINKS": "true"}, "/assets/a.png?type=image&w=10", "https", `<https://cdn.example.com/assets/a.png>; rel="canonical"`},
+		{"escaped path", map[string]string{"CANONICAL_LINKS": "true"}, "/assets/my%20photo.png?type=image&w=10", "", `<http://cdn.example.com/assets/my%20photo.png>; rel="canonical"`},
+		{"original", map[string]string{"CANONICAL_LINKS": "true"}, "/assets/a.png", "", ""},
+		{"disabled", nil, "/assets/a.png?type=image&w=10", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resized string
+			backend := resizerBackend(t, &resized)
+			cfg := testConfig(t, backend.URL, tt.env)
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			req.Host = "cdn.example.com"
+			if tt.proto != "" {
+				req.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			rec := serve(cfg, nil, req)
+
+			if got := rec.Header().Get("Link"); got != tt.want {
+				t.Errorf("Link = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFocusPoint(t *testing.T) {
+	tests := []struct {
+		query      string
+		wantStatus int
+		want       string
+	}{
+		{"type=image&w=10&fpx=0.5&fpy=0.25", http.StatusOK, "/insecure/w:10/g:fp:0.5:0.25/plain/"},
+		{"type=image&fpx=0&fpy=1", http.StatusOK, "/insecure/g:fp:0:1/plain/"},
+		{"type=image&fpx=0.500&fpy=.1", http.StatusOK, "/insecure/g:fp:0.5:0.1/plain/"},
+		{"type=image&fpx=0.5", http.StatusBadRequest, ""},
+		{"type=image&fpx=1.5&fpy=0.5", http.StatusBadRequest, ""},
+		{"type=image&fpx=-0.1&fpy=0.5", http.StatusBadRequest, ""},
+		{"type=image&fpx=left&fpy=0.5", http.StatusBadRequest, ""},
+		{"type=image&fpx=NaN&fpy=0.5", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			rec, resized := resize(t, nil, "photo.png?"+tt.query)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if !strings.HasPrefix(resized, tt.want) {
+				t.Errorf("resizer path = %q, want prefix %q", resized, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	tests := []struct {
+		query      string
+		wantStatus int
+		want       string
+	}{
+		{"type=image&w=10&maxbytes=50000", http.StatusOK, "/insecure/w:10/mb:50000/plain/"},
+		{"type=image&maxbytes=1", http.StatusOK, "/insecure/mb:1/plain/"},
+		{"type=image&maxbytes=0", http.StatusBadRequest, ""},
+		{"type=image&maxbytes=-5", http.StatusBadRequest, ""},
+		{"type=image&maxbytes=10kb", http.StatusBadRequest, ""},
+		{"type=image&maxbytes=", http.StatusOK, "/insecure/plain/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			rec, resized := resize(t, nil, "photo.png?"+tt.query)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if !strings.HasPrefix(resized, tt.want) {
+				t.Errorf("resizer path = %q, want prefix %q", resized, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowedResizeOptions(t *testing.T) {
+	tests := []struct {
+		name       string
+		allowed    string
+		query      string
+		dpr        string
+		wantStatus int
+		want       string
+	}{
+		{"all allowed by default", "", "type=image&w=10&ra=cubic", "2", http.StatusOK, "/insecure/w:10/dpr:2/ra:cubic/plain/"},
+		{"allowed", "w,h", "type=image&w=10&h=5", "", http.StatusOK, "/insecure/w:10/h:5/plain/"},
+		{"disallowed", "w,h", "type=image&w=10&ra=cubic", "", http.StatusBadRequest, ""},
+		{"dpr hint skipped", "w", "type=image&w=10", "2", http.StatusOK, "/insecure/w:10/plain/"},
+		{"dpr allowed", "w, dpr", "type=image&w=10", "2", http.StatusOK, "/insecure/w:10/dpr:2/plain/"},
+		{"gravity", "g", "type=image&fpx=0.5&fpy=0.5", "", http.StatusOK, "/insecure/g:fp:0.5:0.5/plain/"},
+		{"gravity disallowed", "w", "type=image&fpx=0.5&fpy=0.5", "", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resized string
+			backend := resizerBackend(t, &resized)
+			cfg := testConfig(t, backend.URL, map[string]string{"RESIZE_ALLOWED_OPTIONS": tt.allowed})
+			req := httptest.NewRequest(http.MethodGet, "/assets/photo.png?"+tt.query, nil)
+			if tt.dpr != "" {
+				req.Header.Set("DPR", tt.dpr)
+			}
+			rec := serve(cfg, nil, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if !strings.HasPrefix(resized, tt.want) {
+				t.Errorf("resizer path = %q, want prefix %q", resized, tt.want)
+			}
+		})
+	}
+}
+
+func TestEmptyAsNoContent(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		body string
+		want int
+	}{
+		{"enabled empty", map[string]string{"EMPTY_AS_NO_CONTENT": "true"}, "", http.StatusNoContent},
+		{"enabled with body", map[string]string{"EMPTY_AS_NO_CONTENT": "true"}, "x", http.StatusOK},
+		{"disabled empty", nil, "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(tt.body))
+			})
+			cfg := testConfig(t, backend.URL, tt.env)
+			rec := serve(cfg, nil, httptest.NewRequest(http.MethodGet, "/assets/a.txt", nil))
+
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if tt.want == http.StatusNoContent && rec.Header().Get("Content-Length") != "" {
+				t.Errorf("Content-Length = %q on a 204", rec.Header().Get("Content-Length"))
+			}
+		})
+	}
+}
+
+func TestCrossOriginResourcePolicy(t *testing.T) {
+	tests := []struct {
+		env  map[string]string
+		want string
+	}{
+		{nil, "cross-origin"},
+		{map[string]string{"CROSS_ORIGIN_RESOURCE_POLICY": "same-site"}, "same-site"},
+		{map[string]string{"CROSS_ORIGIN_RESOURCE_POLICY": "same-origin"}, "same-origin"},
+	}
+	paths := []string{"/assets/a.txt", "/sprite?icons=a.png,b.png", "/manifest/a.png", "/assets/a.png?blurhash=1"}
+	icon := solidPNG(t, 4, 4, red)
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Write(icon)
+			})
+			env := map[string]string{"VARIANT_WIDTHS": "320"}
+			for name, value := range tt.env {
+				env[name] = value
+			}
+			cfg := testConfig(t, backend.URL, env)
+			for _, path := range paths {
+				rec := serve(cfg, nil, httptest.NewRequest(http.MethodGet, path, nil))
+				if rec.Code != http.StatusOK {
+					t.Fatalf("%s: status = %d, want 200", path, rec.Code)
+				}
+				if got := rec.Header().Get("Cross-Origin-Resource-Policy"); got != tt.want {
+					t.Errorf("%s: Cross-Origin-Resource-Policy = %q, want %q", path, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestResizedHeader(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		query string
+		want  string
+	}{
+		{"resized", map[string]string{"RESIZED_HEADER": "X-Resized"}, "type=image&w=10", "true"},
+		{"original", map[string]string{"RESIZED_HEADER": "X-Resized"}, "", "false"},
+		{"small source skipped", map[string]string{"RESIZED_HEADER": "X-Resized", "RESIZE_MIN_SOURCE_SIZE": "1000"}, "type=image&w=10", "false"},
+		{"disabled", nil, "type=image&w=10", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, _ := resize(t, tt.env, "photo.png?"+tt.query)
+			if got := rec.Header().Get("X-Resized"); got != tt.want {
+				t.Errorf("X-Resized = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransparentGunzip(t *testing.T) {
+	body := strings.Repeat("uncompressed body ", 100)
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte(body))
+	gz.Close()
+
+	tests := []struct {
+		name         string
+		env          map[string]string
+		path         string
+		wantLength   string
+		wantEncoding string
+	}{
+		{"streamed", nil, "a.txt", "", ""},
+		{"buffered", nil, "a.png", strconv.Itoa(len(body)), ""},
+		{"recompressed", map[string]string{"COMPRESS_TYPES": "text/"}, "a.txt", "", "gzip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Encoding", "gzip")
+				w.Header().Set("Content-Length", strconv.Itoa(compressed.Len()))
+				w.Header().Set("Content-Type", getContentTypeFromFilename(r.URL.Path))
+				w.Write(compressed.Bytes())
+			})
+			cfg := testConfig(t, backend.URL, tt.env)
+			req := httptest.NewRequest(http.MethodGet, "/assets/"+tt.path, nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			rec := serve(cfg, nil, req)
+
+			if got := rec.Header().Get("Content-Length"); got != tt.wantLength {
+				t.Errorf("Content-Length = %q, want %q", got, tt.wantLength)
+			}
+			if got := rec.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+			var got io.Reader = rec.Body
+			if tt.wantEncoding == "gzip" {
+				r, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = r
+			}
+			if data, _ := io.ReadAll(got); string(data) != body {
+				t.Errorf("body = %q, want the uncompressed body", data)
+			}
+		})
+	}
+}
+
+func TestResizePresets(t *testing.T) {
+	env := map[string]string{"RESIZE_PRESETS": "thumb=type=image&w=200&h=200; hero=type=image&w=1600&ra=lanczos3"}
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		want       string
+	}{
+		{"thumb", "preset=thumb", http.StatusOK, "/insecure/w:200/h:200/plain/"},
+		{"hero", "preset=hero", http.StatusOK, "/insecure/w:1600/ra:lanczos3/plain/"},
+		{"explicit wins", "preset=thumb&w=100", http.StatusOK, "/insecure/w:100/h:200/plain/"},
+		{"unknown", "preset=banner", http.StatusBadRequest, ""},
+		{"no preset", "w=100", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, resized := resize(t, env, "photo.png?"+tt.query)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.want == "" && resized != "" {
+				t.Errorf("resizer called with %q", resized)
+			}
+			if !strings.HasPrefix(resized, tt.want) {
+				t.Errorf("resizer path = %q, want prefix %q", resized, tt.want)
+			}
+		})
+	}
+}
+
+func TestLossless(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+		want       string
+	}{
+		{"webp", "shot.webp?type=image&w=100&lossless=1", http.StatusOK, "/insecure/w:100/webpo:lossless/plain/"},
+		{"webp uppercase", "shot.WEBP?type=image&lossless=1", http.StatusOK, "/insecure/webpo:lossless/plain/"},
+		{"not requested", "shot.webp?type=image&w=100", http.StatusOK, "/insecure/w:100/plain/"},
+		{"other value", "shot.webp?type=image&w=100&lossless=true", http.StatusOK, "/insecure/w:100/plain/"},
+		{"png", "shot.png?type=image&w=100&lossless=1", http.StatusBadRequest, ""},
+		{"jpeg", "shot.jpg?type=image&lossless=1", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, resized := resize(t, nil, tt.path)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.want == "" && resized != "" {
+				t.Errorf("resizer called with %q", resized)
+			}
+			if !strings.HasPrefix(resized, tt.want) {
+				t.Errorf("resizer path = %q, want prefix %q", resized, tt.want)
+			}
+		})
+	}
+}
+
+func TestNetworkErrorLogging(t *testing.T) {
+	tests := []struct {
+		name         string
+		reportURL    string
+		maxAge       time.Duration
+		wantNEL      string
+		wantReportTo string
+	}{
+		{"one day", "https://reports.example/nel", 24 * time.Hour, `{"report_to":"cdn-errors","max_age":86400}`, `{"endpoints":[{"url":"https://reports.example/nel"}],"group":"cdn-errors","max_age":86400}`},
+		{"one hour", "https://r.example", time.Hour, `{"report_to":"cdn-errors","max_age":3600}`, `{"endpoints":[{"url":"https://r.example"}],"group":"cdn-errors","max_age":3600}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := networkErrorLogging(tt.reportURL, tt.maxAge)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNotFound)
+			}))
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/assets/a.txt", nil))
+
+			if got := rec.Header().Get("NEL"); got != tt.wantNEL {
+				t.Errorf("NEL = %q, want %q", got, tt.wantNEL)
+			}
+			if got := rec.Header().Get("Report-To"); got != tt.wantReportTo {
+				t.Errorf("Report-To = %q, want %q", got, tt.wantReportTo)
+			}
+		})
+	}
+}
+
+func TestDenyPaths(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        map[string]string
+		path       string
+		wantStatus int
+		wantLog    bool
+	}{
+		{"denied", map[string]string{"DENY_PATHS": `(^|/)(\.env|wp-admin)`}, "wp-admin/setup.php", http.StatusNotFound, false},
+		{"denied nested", map[string]string{"DENY_PATHS": `(^|/)(\.env|wp-admin)`}, "app/.env", http.StatusNotFound, false},
+		{"denied escaped", map[string]string{"DENY_PATHS": `(^|/)(\.env|wp-admin)`}, "%2Eenv", http.StatusNotFound, false},
+		{"denied with debug log", map[string]string{"DENY_PATHS": `\.env`, "DENY_PATHS_DEBUG": "true"}, ".env", http.StatusNotFound, true},
+		{"allowed", map[string]string{"DENY_PATHS": `(^|/)(\.env|wp-admin)`}, "css/site.css", http.StatusOK, false},
+		{"not configured", nil, ".env", http.StatusOK, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contacted := false
+			backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				contacted = true
+			})
+			cfg := testConfig(t, backend.URL, tt.env)
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+			rec := serve(cfg, nil, httptest.NewRequest(http.MethodGet, "/assets/"+tt.path, nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if contacted != (tt.wantStatus == http.StatusOK) {
+				t.Errorf("backend contacted = %v", contacted)
+			}
+			if got := strings.Contains(logs.String(), "denylist"); got != tt.wantLog {
+				t.Errorf("logged = %v, want %v: %q", got, tt.wantLog, logs.String())
+			}
+		})
+	}
+}
+
+func TestFoldParamCase(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"known upper", "W=100&H=50", "w=100&h=50"},
+		{"mixed case", "Type=image&Blurhash=1", "type=image&blurhash=1"},
+		{"values kept", "RA=Lanczos3&Type=a%20b", "ra=Lanczos3&type=a%20b"},
+		{"order kept", "W=100&w=200", "w=100&w=200"},
+		{"escaped name", "%57=100", "w=100"},
+		{"unknown kept", "Sig=AbC&W=1", "Sig=AbC&w=1"},
+		{"unchanged", "w=100&Sig=AbC", "w=100&Sig=AbC"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/assets/a.png?"+tt.query, nil)
+			foldParamCase(r)
+			if r.URL.RawQuery != tt.want {
+				t.Errorf("query = %q, want %q", r.URL.RawQuery, tt.want)
+			}
+		})
+	}
+}
+
+func TestCaseInsensitiveParams(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want string
+	}{
+		{"enabled", map[string]string{"CASE_INSENSITIVE_PARAMS": "true"}, "/insecure/w:100/h:50/plain/"},
+		{"disabled", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, resized := resize(t, tt.env, "photo.png?TYPE=image&W=100&H=50")
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", rec.Code)
+			}
+			if tt.want == "" && resized != "" {
+				t.Errorf("resizer called with %q", resized)
+			}
+			if !strings.HasPrefix(resized, tt.want) {
+				t.Errorf("resizer path = %q, want prefix %q", resized, tt.want)
+			}
+		})
+	}
+}
+
+func TestNoStorePrefixes(t *testing.T) {
+	files := map[string][]byte{
+		"private/a.png":     solidPNG(t, 2, 2, red),
+		"private/a-100.png": solidPNG(t, 2, 2, red),
+		"public/b.png":      solidPNG(t, 2, 2, blue),
+		"public/b-100.png":  solidPNG(t, 2, 2, blue),
+	}
+	tests := []struct {
+		name   string
+		prefix string
+		target string
+		want   string
+	}{
+		{"asset under prefix", "private/", "/assets/private/a.png", cacheNoStore},
+		{"asset outside prefix", "private/", "/assets/public/b.png", cacheMaxAge},
+		{"prefix with assets", "/assets/private/", "/assets/private/a.png", cacheNoStore},
+		{"sprite with one private icon", "private/", "/sprite?icons=public/b.png,private/a.png", cacheNoStore},
+		{"sprite of public icons", "private/", "/sprite?icons=public/b.png", cacheMaxAge},
+		{"manifest under prefix", "private/", "/manifest/private/a.png", cacheNoStore},
+		{"manifest outside prefix", "private/", "/manifest/public/b.png", cacheMaxAge},
+		{"not configured", "", "/assets/private/a.png", cacheMaxAge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, iconBackend(t, files).URL, map[string]string{"NO_STORE_PREFIXES": tt.prefix, "VARIANT_WIDTHS": "100"})
+
+			rec := serve(cfg, nil, httptest.NewRequest(http.MethodGet, tt.target, nil))
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body)
+			}
+			if got := rec.Header().Get("Cache-Control"); got != tt.want {
+				t.Errorf("Cache-Control = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNoRangesForProcessedBodies(t *testing.T) {
+	content := `{ "items": [ 1, 2, 3, 4, 5, 6, 7, 8, 9, 10 ] }`
+	tests := []struct {
+		name             string
+		env              map[string]string
+		path             string
+		acceptEncoding   string
+		noRange          bool
+		wantStatus       int
+		wantAcceptRanges string
+	}{
+		{"raw", nil, "data.json", "", false, http.StatusPartialContent, "bytes"},
+		{"resized", nil, "photo.png?type=image&w=10", "", false, http.StatusOK, ""},
+		{"transformed", map[string]string{"TRANSFORMERS": "json-compact"}, "data.json", "", false, http.StatusOK, ""},
+		{"transformer not matching", map[string]string{"TRANSFORMERS": "json-compact"}, "data.bin", "", false, http.StatusPartialContent, "bytes"},
+		{"compressed", map[string]string{"COMPRESS_TYPES": "application/json", "GZIP_MIN_SIZE": "1"}, "data.json", "gzip", true, http.StatusOK, ""},
+		{"ranged type not compressed", map[string]string{"COMPRESS_TYPES": "application/json", "GZIP_MIN_SIZE": "1"}, "data.json", "gzip", false, http.StatusPartialContent, "bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", getContentTypeFromFilename(r.URL.Path))
+				http.ServeContent(w, r, "", time.Time{}, strings.NewReader(content))
+			})
+			cfg := testConfig(t, backend.URL, tt.env)
+			req := httptest.NewRequest(http.MethodGet, "/assets/"+tt.path, nil)
+			if !tt.noRange {
+				req.Header.Set("Range", "bytes=0-3")
+			}
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+
+			rec := serve(cfg, nil, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Accept-Ranges"); got != tt.wantAcceptRanges {
+				t.Errorf("Accept-Ranges = %q, want %q", got, tt.wantAcceptRanges)
+			}
+			if rec.Code == http.StatusOK && rec.Header().Get("Content-Range") != "" {
+				t.Errorf("Content-Range = %q on a whole body", rec.Header().Get("Content-Range"))
+			}
+		})
+	}
+}
+
+func TestNormalizeOrientation(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		path string
+		want string
+	}{
+		{"enabled", map[string]string{"NORMALIZE_ORIENTATION": "true"}, "photo.jpg?type=image&w=100", "/insecure/w:100/ar:1/sm:1/plain/"},
+		{"enabled without options", map[string]string{"NORMALIZE_ORIENTATION": "true"}, "photo.jpg?type=image", "/insecure/ar:1/sm:1/plain/"},
+		{"outside allowlist", map[string]string{"NORMALIZE_ORIENTATION": "true", "RESIZE_ALLOWED_OPTIONS": "w"}, "photo.jpg?type=image&w=100", "/insecure/w:100/ar:1/sm:1/plain/"},
+		{"not counted towards cap", map[string]string{"NORMALIZE_ORIENTATION": "true", "MAX_RESIZE_OPTIONS": "1"}, "photo.jpg?type=image&w=100", "/insecure/w:100/ar:1/sm:1/plain/"},
+		{"disabled", nil, "photo.jpg?type=image&w=100", "/insecure/w:100/plain/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, resized := resize(t, tt.env, tt.path)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body)
+			}
+			if !strings.HasPrefix(resized, tt.want) {
+				t.Errorf("resizer path = %q, want prefix %q", resized, tt.want)
+			}
+		})
+	}
+}
+
+func TestContentTypes(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		path string
+		want string
+	}{
+		{"webp", nil, "img/a.webp", "image/webp"},
+		{"avif", nil, "a.avif", "image/avif"},
+		{"heic", nil, "a.heic", "image/heic"},
+		{"jxl", nil, "a.jxl", "image/jxl"},
+		{"woff2", nil, "fonts/a.woff2", "font/woff2"},
+		{"wasm", nil, "app.wasm", "application/wasm"},
+		{"webmanifest", nil, "site.webmanifest", "application/manifest+json"},
+		{"javascript module", nil, "app.mjs", "text/javascript; charset=utf-8"},
+		{"uppercase", nil, "A.WEBP", "image/webp"},
+		{"precompressed", nil, "site.css.br", "text/css; charset=utf-8"},
+		{"source url query", nil, "https://img.example/a.avif?v=2", "image/avif"},
+		{"unknown", nil, "a.unknownext", defaultMediaType},
+		{"no extension", nil, "README", defaultMediaType},
+		{"override", map[string]string{"CONTENT_TYPES": "js=application/javascript"}, "app.js", "application/javascript"},
+		{"added", map[string]string{"CONTENT_TYPES": ".GLB=model/gltf-binary"}, "scene.glb", "model/gltf-binary"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testConfig(t, "http://backend.invalid", tt.env)
+			if got := getContentTypeFromFilename(tt.path); got != tt.want {
+				t.Errorf("getContentTypeFromFilename(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
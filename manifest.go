@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type variant struct {
+	Width int    `json:"width"`
+	URL   string `json:"url"`
+	Size  int64  `json:"size,omitempty"`
+}
+
+// variantPath names the pre-rendered copy of asset at width according to
+// VARIANT_NAME_FORMAT, where {name}, {width} and {ext} stand for the file
+// name without extension, the width and the extension with its dot.
+func variantPath(format, asset string, width int) string {
+	ext := path.Ext(asset)
+	dir, file := path.Split(strings.TrimSuffix(asset, ext))
+	name := strings.NewReplacer("{name}", file, "{width}", strconv.Itoa(width), "{ext}", ext).Replace(format)
+	return dir + name
+}
+
+// manifestHandler lists the pre-rendered resolutions of an asset as JSON so
+// clients can pick one instead of asking for a resize. Variants are found
+// by naming convention: each configured width is checked on the asset
+// backend with a HEAD request and only those that exist are returned.
+func manifestHandler(cfg *config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		asset, err := url.PathUnescape(strings.Trim(chi.URLParam(r, "*"), "/"))
+		if err != nil || asset == "" || isValidURL(asset) {
+			writeError(w, r, http.StatusBadRequest, "path must be an asset path")
+			return
+		}
+
+		// A variant's size is that of the whole file, not of a range.
+		header := upstreamHeaders(r, cfg, target{url: fmt.Sprintf("%s/assets/%s", cfg.assetsApiHost, asset), backend: backendAssets})
+		header.Del("Range")
+		header.Del("If-Range")
+		found := make([]*variant, len(cfg.variantWidths))
+		var wg sync.WaitGroup
+		for i, width := range cfg.variantWidths {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				name := variantPath(cfg.variantNameFormat, asset, width)
+				info, err := headAsset(r.Context(), fmt.Sprintf("%s/assets/%s", cfg.assetsApiHost, name), backendAssets, header.Clone())
+				if err == nil {
+					found[i] = &variant{Width: width, URL: "/assets/" + name, Size: max(info.size, 0)}
+				}
+			}()
+		}
+		wg.Wait()
+
+		variants := []variant{}
+		for _, v := range found {
+			if v != nil {
+				variants = append(variants, *v)
+			}
+		}
+		if len(variants) == 0 {
+			writeError(w, r, http.StatusNotFound, "no variants found")
+			return
+		}
+		body, _ := json.Marshal(map[string]any{"asset": "/assets/" + asset, "variants": variants})
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", cacheControlFor(cfg, asset))
+		setCrossOriginHeaders(w.Header(), cfg)
+		writeBody(w, r, http.StatusOK, append(body, '\n'))
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestVariantPath(t *testing.T) {
+	tests := []struct {
+		format string
+		asset  string
+		width  int
+		want   string
+	}{
+		{"{name}-{width}{ext}", "photo.jpg", 320, "photo-320.jpg"},
+		{"{name}-{width}{ext}", "img/2024/photo.jpg", 640, "img/2024/photo-640.jpg"},
+		{"{width}/{name}{ext}", "img/photo.png", 100, "img/100/photo.png"},
+		{"{name}@{width}w{ext}", "logo.min.svg", 64, "logo.min@64w.svg"},
+		{"{name}-{width}", "noext", 10, "noext-10"},
+	}
+	for _, tt := range tests {
+		if got := variantPath(tt.format, tt.asset, tt.width); got != tt.want {
+			t.Errorf("variantPath(%q, %q, %d) = %q, want %q", tt.format, tt.asset, tt.width, got, tt.want)
+		}
+	}
+}
+
+func TestManifest(t *testing.T) {
+	stored := map[string]int{
+		"/assets/img/photo-320.jpg":  3200,
+		"/assets/img/photo-1280.jpg": 12800,
+		"/assets/img/320/photo.jpg":  320,
+	}
+	tests := []struct {
+		name       string
+		env        map[string]string
+		path       string
+		wantStatus int
+		want       []variant
+	}{
+		{"some widths exist", nil, "img/photo.jpg", http.StatusOK, []variant{
+			{Width: 320, URL: "/assets/img/photo-320.jpg", Size: 3200},
+			{Width: 1280, URL: "/assets/img/photo-1280.jpg", Size: 12800},
+		}},
+		{"custom format", map[string]string{"VARIANT_NAME_FORMAT": "{width}/{name}{ext}"}, "img/photo.jpg", http.StatusOK, []variant{
+			{Width: 320, URL: "/assets/img/320/photo.jpg", Size: 320},
+		}},
+		{"no variants", nil, "img/other.jpg", http.StatusNotFound, nil},
+		{"empty path", nil, "", http.StatusBadRequest, nil},
+		{"absolute url", nil, "https%3A%2F%2Fexample.com%2Fa.jpg", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				size, ok := stored[r.URL.Path]
+				if !ok || r.Method != http.MethodHead {
+					http.NotFound(w, r)
+					return
+				}
+				w.Header().Set("Content-Length", strconv.Itoa(size))
+			})
+			env := map[string]string{"VARIANT_WIDTHS": "320,640,1280"}
+			for name, value := range tt.env {
+				env[name] = value
+			}
+			cfg := testConfig(t, backend.URL, env)
+
+			rec := serve(cfg, nil, httptest.NewRequest(http.MethodGet, "/manifest/"+tt.path, nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if got := rec.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", got)
+			}
+			var body struct {
+				Asset    string    `json:"asset"`
+				Variants []variant `json:"variants"`
+			}
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if want := "/assets/" + tt.path; body.Asset != want {
+				t.Errorf("asset = %q, want %q", body.Asset, want)
+			}
+			if !slices.Equal(body.Variants, tt.want) {
+				t.Errorf("variants = %+v, want %+v", body.Variants, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"mime"
+	"net/http/httptrace"
+	"slices"
+)
+
+// upstreamConnections counts connections used for backend requests, keyed
+// "<backend>_reused" and "<backend>_new". It is served on /debug/vars.
+var upstreamConnections = expvar.NewMap("upstream_connections")
+
+// bytesServed counts asset body bytes sent to clients, keyed
+// "<content type>|resized" or "<content type>|raw". Types outside
+// trackedContentTypes are bucketed as "other" to bound cardinality.
+var bytesServed = expvar.NewMap("bytes_served")
+
+var trackedContentTypes = []string{
+	"image/jpeg", "image/png", "image/gif", "image/webp", "image/avif", "image/svg+xml",
+	"text/css", "text/javascript", "application/javascript", "application/json",
+	"font/woff2", "video/mp4", "application/pdf",
+}
+
+func recordBytesServed(contentType string, resized bool, n int64) {
+	label, _, err := mime.ParseMediaType(contentType)
+	if err != nil || !slices.Contains(trackedContentTypes, label) {
+		label = "other"
+	}
+	if resized {
+		label += "|resized"
+	} else {
+		label += "|raw"
+	}
+	bytesServed.Add(label, n)
+}
+
+// withConnTrace attaches a ClientTrace that records whether the request got
+// a pooled connection or had to dial a new one.
+func withConnTrace(ctx context.Context, backend string) context.Context {
+	if backend == "" {
+		backend = "external"
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				upstreamConnections.Add(backend+"_reused", 1)
+			} else {
+				upstreamConnections.Add(backend+"_new", 1)
+			}
+		},
+	})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// counter returns the current value of an expvar map entry.
+func counter(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestUpstreamConnections(t *testing.T) {
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	cfg := testConfig(t, backend.URL, nil)
+
+	tests := []struct {
+		name       string
+		path       string
+		wantNew    string
+		wantReused string
+	}{
+		{"first request dials", "a.txt", "assets_new", ""},
+		{"second request reuses", "b.txt", "", "assets_reused"},
+		{"resizer", "c.png?type=image", "", "resizer_reused"},
+		{"external", url.QueryEscape(backend.URL + "/d.txt"), "", "external_reused"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := map[string]int64{}
+			for _, key := range []string{tt.wantNew, tt.wantReused} {
+				before[key] = counter(upstreamConnections, key)
+			}
+			rec := serve(cfg, nil, httptest.NewRequest(http.MethodGet, "/assets/"+tt.path, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", rec.Code)
+			}
+			for _, key := range []string{tt.wantNew, tt.wantReused} {
+				if key != "" && counter(upstreamConnections, key) <= before[key] {
+					t.Errorf("%s was not incremented", key)
+				}
+			}
+		})
+	}
+}
+
+func TestRecordBytesServed(t *testing.T) {
+	tests := []struct {
+		contentType string
+		resized     bool
+		want        string
+	}{
+		{"image/png", false, "image/png|raw"},
+		{"image/png", true, "image/png|resized"},
+		{"text/css; charset=utf-8", false, "text/css|raw"},
+		{"application/x-unknown", false, "other|raw"},
+		{"", true, "other|resized"},
+		{"not a type;;", false, "other|raw"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			before := counter(bytesServed, tt.want)
+			recordBytesServed(tt.contentType, tt.resized, 42)
+			if got := counter(bytesServed, tt.want) - before; got != 42 {
+				t.Errorf("%s grew by %d, want 42", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestBytesServed(t *testing.T) {
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", getContentTypeFromFilename(r.URL.Path))
+		w.Write([]byte(r.URL.Path))
+	})
+	tests := []struct {
+		name  string
+		path  string
+		label string
+	}{
+		{"raw css", "site.css", "text/css|raw"},
+		{"raw other", "data.bin", "other|raw"},
+		{"resized", "photo.png?type=image&w=10", "image/png|resized"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, backend.URL, nil)
+			before := counter(bytesServed, tt.label)
+			rec := serve(cfg, nil, httptest.NewRequest(http.MethodGet, "/assets/"+tt.path, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", rec.Code)
+			}
+			if got, want := counter(bytesServed, tt.label)-before, int64(rec.Body.Len()); got != want {
+				t.Errorf("%s grew by %d, want %d", tt.label, got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+// loadClientCert reads the client certificate a backend requires for
+// mutual TLS from the <prefix>_CLIENT_CERT and <prefix>_CLIENT_KEY files.
+// It exits when only one is set or the pair does not load, so a broken
+// certificate is caught at startup instead of on the first fetch.
+func loadClientCert(prefix string) *tls.Certificate {
+	certFile := getEnv(prefix+"_CLIENT_CERT", "")
+	keyFile := getEnv(prefix+"_CLIENT_KEY", "")
+	if certFile == "" && keyFile == "" {
+		return nil
+	}
+	if certFile == "" || keyFile == "" {
+		log.Fatalf("%s_CLIENT_CERT and %s_CLIENT_KEY must be set together", prefix, prefix)
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		log.Fatalf("%s client certificate: %s", prefix, err)
+	}
+	return &cert
+}
+
+// backendTransports sends each request through the transport for its host,
+// so connections to an mTLS backend present that backend's certificate and
+// no other host ever sees it. Other hosts use the default transport.
+type backendTransports struct {
+	hosts    map[string]http.RoundTripper
+	fallback http.RoundTripper
+}
+
+func (t backendTransports) RoundTrip(req *http.Request) (*http.Response, error) {
+	if rt, ok := t.hosts[req.URL.Host]; ok {
+		return rt.RoundTrip(req)
+	}
+	return t.fallback.RoundTrip(req)
+}
+
+// clientCertTransport wraps base so that requests to each backend's host
+// present its client certificate. Fallback hosts are not given the asset
+// backend's certificate, just as they are not sent its credentials. It
+// returns base when no certificate is set.
+func clientCertTransport(cfg *config, base *http.Transport) http.RoundTripper {
+	if len(cfg.clientCerts) == 0 {
+		return base
+	}
+	backendHosts := map[string]string{
+		backendAssets:  cfg.assetsApiHost,
+		backendResizer: cfg.resizerApiHost,
+	}
+	transports := backendTransports{hosts: map[string]http.RoundTripper{}, fallback: base}
+	for backend, cert := range cfg.clientCerts {
+		transport := base.Clone()
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+		if u, err := url.Parse(backendHosts[backend]); err == nil {
+			transports.hosts[u.Host] = transport
+		}
+	}
+	return transports
+}
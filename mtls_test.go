@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// clientCert writes a self-signed client certificate and its key to dir
+// and returns the file names and the parsed certificate.
+func clientCert(t *testing.T, dir string) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "cdn-api"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ = x509.ParseCertificate(der)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile, cert
+}
+
+// tlsBackend starts a TLS server that asks for a client certificate signed
+// by ca, requiring one when require is set, and records whether one was
+// presented.
+func tlsBackend(t *testing.T, ca *x509.Certificate, require bool, presented *bool) *httptest.Server {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*presented = len(r.TLS.PeerCertificates) > 0
+		w.Write([]byte("secret"))
+	}))
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	srv.TLS = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: pool}
+	if require {
+		srv.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, ca := clientCert(t, dir)
+	tests := []struct {
+		name          string
+		env           map[string]string
+		external      bool // fetch from a second host by absolute URL
+		wantStatus    int
+		wantPresented bool
+	}{
+		{"certificate presented", map[string]string{"ASSETS_API_CLIENT_CERT": certFile, "ASSETS_API_CLIENT_KEY": keyFile}, false, http.StatusOK, true},
+		{"no certificate", nil, false, http.StatusInternalServerError, false},
+		{"not sent to other hosts", map[string]string{"ASSETS_API_CLIENT_CERT": certFile, "ASSETS_API_CLIENT_KEY": keyFile}, true, http.StatusOK, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var presented bool
+			backend := tlsBackend(t, ca, true, &presented)
+			other := tlsBackend(t, ca, false, &presented)
+			cfg := testConfig(t, backend.URL, tt.env)
+
+			roots := x509.NewCertPool()
+			roots.AddCert(backend.Certificate())
+			roots.AddCert(other.Certificate())
+			base := http.DefaultTransport.(*http.Transport).Clone()
+			base.TLSClientConfig = &tls.Config{RootCAs: roots}
+			httpClient = &http.Client{Transport: clientCertTransport(cfg, base)}
+
+			path := "/assets/a.txt"
+			if tt.external {
+				path = "/assets/" + url.QueryEscape(other.URL+"/a.txt")
+			}
+			rec := serve(cfg, nil, httptest.NewRequest(http.MethodGet, path, nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if presented != tt.wantPresented {
+				t.Errorf("certificate presented = %v, want %v", presented, tt.wantPresented)
+			}
+		})
+	}
+}
+
+func TestClientCertTransport(t *testing.T) {
+	cert := &tls.Certificate{}
+	cfg := &config{
+		assetsApiHost:  "https://assets.example",
+		resizerApiHost: "https://resizer.example",
+		fallbackHosts:  []string{"https://mirror.example"},
+		clientCerts:    map[string]*tls.Certificate{backendAssets: cert},
+	}
+	base := &http.Transport{TLSClientConfig: &tls.Config{ServerName: "kept"}}
+
+	transports, ok := clientCertTransport(cfg, base).(backendTransports)
+	if !ok {
+		t.Fatal("no per-host transports")
+	}
+	tests := []struct {
+		host     string
+		wantCert bool
+	}{
+		{"assets.example", true},
+		{"mirror.example", false},
+		{"resizer.example", false},
+		{"other.example", false},
+	}
+	for _, tt := range tests {
+		rt, ok := transports.hosts[tt.host]
+		if ok != tt.wantCert {
+			t.Errorf("%s has a certificate transport: %v, want %v", tt.host, ok, tt.wantCert)
+		}
+		if ok && rt.(*http.Transport).TLSClientConfig.ServerName != "kept" {
+			t.Errorf("%s lost the base TLS settings", tt.host)
+		}
+	}
+	if base.TLSClientConfig.Certificates != nil {
+		t.Error("base transport was given the certificate")
+	}
+	if got := clientCertTransport(&config{}, base); got != base {
+		t.Error("transport wrapped without certificates")
+	}
+}
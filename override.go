@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// backendOverride returns the asset backend to use for a request. A trusted
+// gateway may pick another backend by sending BACKEND_OVERRIDE_HEADER as
+// "<backend url>;<hex HMAC-SHA256 of the url>", keyed with
+// BACKEND_OVERRIDE_SECRET. The host must be in BACKEND_OVERRIDE_HOSTS.
+// Missing, unsigned or invalid overrides fall back to ASSETS_API_HOST.
+func backendOverride(r *http.Request, cfg *config) string {
+	if cfg.overrideSecret == "" {
+		return cfg.assetsApiHost
+	}
+	value := r.Header.Get(cfg.overrideHeader)
+	if value == "" {
+		return cfg.assetsApiHost
+	}
+
+	host, signature, ok := strings.Cut(value, ";")
+	if !ok || !validOverrideSignature(cfg.overrideSecret, host, signature) {
+		log.Printf("ignoring %s with invalid signature", cfg.overrideHeader)
+		return cfg.assetsApiHost
+	}
+	u, err := url.Parse(host)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || !slices.Contains(cfg.overrideHosts, u.Host) {
+		log.Printf("ignoring %s for host not in BACKEND_OVERRIDE_HOSTS", cfg.overrideHeader)
+		return cfg.assetsApiHost
+	}
+	return strings.TrimSuffix(host, "/")
+}
+
+func validOverrideSignature(secret, host, signature string) bool {
+	got, err := hex.DecodeString(strings.TrimSpace(signature))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(host))
+	return hmac.Equal(got, mac.Sum(nil))
+}
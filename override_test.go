@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func sign(secret, host string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(host))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestBackendOverride(t *testing.T) {
+	var authorization string
+	primary := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("primary"))
+	})
+	other := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.Write([]byte("other"))
+	})
+	otherHost := strings.TrimPrefix(other.URL, "http://")
+	env := map[string]string{
+		"BACKEND_OVERRIDE_SECRET": "s3cret",
+		"BACKEND_OVERRIDE_HOSTS":  otherHost,
+		"ASSETS_API_HEADERS":      "Authorization: Bearer primary",
+	}
+
+	tests := []struct {
+		name   string
+		env    map[string]string
+		header string
+		want   string
+	}{
+		{"signed", env, other.URL + ";" + sign("s3cret", other.URL), "other"},
+		{"trailing slash", env, other.URL + "/;" + sign("s3cret", other.URL+"/"), "other"},
+		{"no header", env, "", "primary"},
+		{"bad signature", env, other.URL + ";" + sign("wrong", other.URL), "primary"},
+		{"malformed signature", env, other.URL + ";zz", "primary"},
+		{"unsigned", env, other.URL, "primary"},
+		{"host not allowed", map[string]string{"BACKEND_OVERRIDE_SECRET": "s3cret", "BACKEND_OVERRIDE_HOSTS": "example.com"}, other.URL + ";" + sign("s3cret", other.URL), "primary"},
+		{"bad scheme", env, "ftp://" + otherHost + ";" + sign("s3cret", "ftp://"+otherHost), "primary"},
+		{"disabled", nil, other.URL + ";" + sign("s3cret", other.URL), "primary"},
+		{"custom header ignored", map[string]string{"BACKEND_OVERRIDE_SECRET": "s3cret", "BACKEND_OVERRIDE_HOSTS": otherHost, "BACKEND_OVERRIDE_HEADER": "X-Origin"}, other.URL + ";" + sign("s3cret", other.URL), "primary"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authorization = ""
+			cfg := testConfig(t, primary.URL, tt.env)
+			req := httptest.NewRequest(http.MethodGet, "/assets/a.txt", nil)
+			if tt.header != "" {
+				req.Header.Set("X-Backend-Override", tt.header)
+			}
+			rec := serve(cfg, nil, req)
+
+			if rec.Body.String() != tt.want {
+				t.Errorf("served by %q, want %q", rec.Body, tt.want)
+			}
+			if authorization != "" {
+				t.Errorf("override host received Authorization %q", authorization)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+type fetchResult struct {
+	resp *http.Response
+	err  error
+}
+
+// fetchResizeBehind fetches resizer output but gives up waiting after
+// RESIZE_TIMEOUT and fetches the original instead, rewriting t to describe
+// it. The abandoned resize keeps running in the background and its output is
+// drained, so any cache in front of the resizer is warm for the next
+// request. It reports whether the original was used.
+func fetchResizeBehind(r *http.Request, cfg *config, t *target) (*http.Response, bool, error) {
+	results := make(chan fetchResult, 1)
+	header := upstreamHeaders(r, cfg, *t)
+	resizeURL, backend := t.url, t.backend
+	go func() {
+		// Detached from the request so the resize can outlive it.
+		resp, err := fetchAsset(context.Background(), resizeURL, backend, header)
+		results <- fetchResult{resp, err}
+	}()
+
+	timer := time.NewTimer(cfg.resizeTimeout)
+	defer timer.Stop()
+	select {
+	case res := <-results:
+		return res.resp, false, res.err
+	case <-timer.C:
+	}
+
+	go func() {
+		if res := <-results; res.resp != nil {
+			io.Copy(io.Discard, res.resp.Body)
+			res.resp.Body.Close()
+		}
+	}()
+
+	*t = t.original()
+	resp, err := fetchAsset(r.Context(), t.url, t.backend, upstreamHeaders(r, cfg, *t))
+	return resp, true, err
+}
+
+// skipSmallSource reports whether a resize can be skipped because the
+// source, as described by a HEAD request, is no more than
+// RESIZE_MIN_SOURCE_SIZE bytes. The threshold is a byte size, not pixel
+// dimensions: small files are assumed to already be small enough. Sources
+// whose size cannot be determined are resized.
+func skipSmallSource(cfg *config, source assetInfo) bool {
+	return cfg.resizeMinSourceSize > 0 && source.size >= 0 && source.size <= cfg.resizeMinSourceSize
+}
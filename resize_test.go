@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResizeTimeout(t *testing.T) {
+	tests := []struct {
+		name             string
+		env              map[string]string
+		path             string
+		resizerDelay     time.Duration
+		wantBody         string
+		wantCacheControl string
+	}{
+		{"fast resizer", map[string]string{"RESIZE_TIMEOUT": "500ms"}, "a.png", 0, "resized", cacheMaxAge},
+		{"slow resizer", map[string]string{"RESIZE_TIMEOUT": "20ms"}, "a.png", 200 * time.Millisecond, "original", "max-age=60, public"},
+		{"configured ttl", map[string]string{"RESIZE_TIMEOUT": "20ms", "RESIZE_FALLBACK_TTL": "10s"}, "a.png", 200 * time.Millisecond, "original", "max-age=10, public"},
+		{"no-store kept", map[string]string{"RESIZE_TIMEOUT": "20ms", "NO_STORE_PREFIXES": "private/"}, "private/a.png", 200 * time.Millisecond, "original", cacheNoStore},
+		{"disabled", nil, "a.png", 50 * time.Millisecond, "resized", cacheMaxAge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasPrefix(r.URL.Path, "/insecure/") {
+					time.Sleep(tt.resizerDelay)
+					w.Header().Set("Content-Type", "image/png")
+					w.Write([]byte("resized"))
+					return
+				}
+				w.Header().Set("ETag", `"v1"`)
+				w.Header().Set("Content-Type", "image/png")
+				w.Write([]byte("original"))
+			})
+			cfg := testConfig(t, backend.URL, tt.env)
+			rec := serve(cfg, nil, httptest.NewRequest(http.MethodGet, "/assets/"+tt.path+"?type=image&w=10", nil))
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", rec.Code)
+			}
+			if rec.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rec.Body, tt.wantBody)
+			}
+			if got := rec.Header().Get("Cache-Control"); got != tt.wantCacheControl {
+				t.Errorf("Cache-Control = %q, want %q", got, tt.wantCacheControl)
+			}
+			// The resized ETag must not be attached to the original.
+			if etag := rec.Header().Get("ETag"); tt.wantBody == "original" && etag != "" {
+				t.Errorf("ETag = %q on the fallback original", etag)
+			}
+		})
+	}
+}
+
+func TestResizeMinSourceSize(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         map[string]string
+		headLength  string // "" declares no length, "404" fails the HEAD
+		wantResized bool
+	}{
+		{"disabled", nil, "100", true},
+		{"below threshold", map[string]string{"RESIZE_MIN_SOURCE_SIZE": "1000"}, "100", false},
+		{"at threshold", map[string]string{"RESIZE_MIN_SOURCE_SIZE": "1000"}, "1000", false},
+		{"above threshold", map[string]string{"RESIZE_MIN_SOURCE_SIZE": "1000"}, "1001", true},
+		{"unknown size", map[string]string{"RESIZE_MIN_SOURCE_SIZE": "1000"}, "", true},
+		{"head fails", map[string]string{"RESIZE_MIN_SOURCE_SIZE": "1000"}, "404", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resized := false
+			backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodHead {
+					switch tt.headLength {
+					case "404":
+						w.WriteHeader(http.StatusNotFound)
+					case "":
+						w.Header().Set("Transfer-Encoding", "chunked")
+					default:
+						w.Header().Set("Content-Length", tt.headLength)
+					}
+					return
+				}
+				if strings.HasPrefix(r.URL.Path, "/insecure/") {
+					resized = true
+				}
+				w.Header().Set("Content-Type", "image/png")
+				w.Write([]byte("image"))
+			})
+			cfg := testConfig(t, backend.URL, tt.env)
+
+			rec := serve(cfg, nil, httptest.NewRequest(http.MethodGet, "/assets/photo.png?type=image&w=100", nil))
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", rec.Code)
+			}
+			if resized != tt.wantResized {
+				t.Errorf("resized = %v, want %v", resized, tt.wantResized)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+const backendShield = "shield"
+
+// fetchShield forwards an asset request to the origin shield, another
+// instance of this proxy that fetches from the origin on behalf of every
+// edge. The request is marked with SHIELD_HEADER so the shield goes to the
+// origin itself even when it also has SHIELD_URL configured. Request
+// headers that affect the response travel along so the shield produces the
+// same variant, as do Cache-Control, whose no-transform the shield has to
+// honour, and a signed backend override, which the shield verifies itself.
+// It returns nil when the shield failed and the origin should be tried
+// directly.
+func fetchShield(r *http.Request, cfg *config, t target) *http.Response {
+	header := http.Header{}
+	for _, name := range append([]string{"Range", "If-Range", "Cache-Control", cfg.overrideHeader}, t.vary...) {
+		if values := r.Header.Values(name); len(values) > 0 {
+			header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	header.Set(cfg.shieldHeader, "1")
+	setTraceHeaders(header, r)
+	resp, err := fetchAsset(r.Context(), strings.TrimSuffix(cfg.shieldURL, "/")+r.URL.RequestURI(), backendShield, header)
+	if err != nil {
+		return nil
+	}
+	return resp
+}
+
+// viaShield reports whether the request should go through the shield: one
+// is configured and the request did not already come from an edge.
+func viaShield(r *http.Request, cfg *config) bool {
+	return cfg.shieldURL != "" && r.Header.Get(cfg.shieldHeader) == ""
+}
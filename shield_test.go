@@ -0,0 +1,190 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestShield(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         map[string]string
+		target      string
+		header      map[string]string
+		shieldFails bool
+		wantBody    string
+		wantHop     string // header expected on the shield request
+		wantHeader  map[string]string
+	}{
+		{"via shield", nil, "/assets/a.txt", nil, false, "shield", "X-Shield-Hop", nil},
+		{"resized via shield", nil, "/assets/a.png?type=image&w=10", nil, false, "shield", "X-Shield-Hop", nil},
+		{"range forwarded", nil, "/assets/a.txt", map[string]string{"Range": "bytes=0-1", "If-Range": `"v1"`}, false, "shield", "X-Shield-Hop", map[string]string{"Range": "bytes=0-1", "If-Range": `"v1"`}},
+		{"no-transform forwarded", nil, "/assets/a.png?type=image&w=10", map[string]string{"Cache-Control": "no-transform"}, false, "shield", "X-Shield-Hop", map[string]string{"Cache-Control": "no-transform"}},
+		{"override forwarded", map[string]string{"BACKEND_OVERRIDE_HEADER": "X-Origin"}, "/assets/a.txt", map[string]string{"X-Origin": "https://other.example;00"}, false, "shield", "X-Shield-Hop", map[string]string{"X-Origin": "https://other.example;00"}},
+		{"custom hop header", map[string]string{"SHIELD_HEADER": "X-Edge"}, "/assets/a.txt", nil, false, "shield", "X-Edge", nil},
+		{"request from an edge", nil, "/assets/a.txt", map[string]string{"X-Shield-Hop": "1"}, false, "origin", "", nil},
+		{"shield failed", nil, "/assets/a.txt", nil, true, "origin", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var shieldReq *http.Request
+			shield := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				shieldReq = r
+				if tt.shieldFails {
+					w.WriteHeader(http.StatusBadGateway)
+					return
+				}
+				w.Write([]byte("shield"))
+			})
+			origin := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("origin"))
+			})
+			env := map[string]string{"SHIELD_URL": shield.URL + "/"}
+			for name, value := range tt.env {
+				env[name] = value
+			}
+			cfg := testConfig(t, origin.URL, env)
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			for name, value := range tt.header {
+				req.Header.Set(name, value)
+			}
+
+			rec := serve(cfg, nil, req)
+
+			if rec.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rec.Body, tt.wantBody)
+			}
+			if tt.wantHop == "" {
+				return
+			}
+			if shieldReq == nil {
+				t.Fatal("shield not contacted")
+			}
+			if shieldReq.URL.RequestURI() != tt.target {
+				t.Errorf("shield asked for %q, want %q", shieldReq.URL.RequestURI(), tt.target)
+			}
+			if got := shieldReq.Header.Get(tt.wantHop); got != "1" {
+				t.Errorf("%s = %q, want 1", tt.wantHop, got)
+			}
+			for name, value := range tt.wantHeader {
+				if got := shieldReq.Header.Get(name); got != value {
+					t.Errorf("shield %s = %q, want %q", name, got, value)
+				}
+			}
+		})
+	}
+}
+
+// shieldChain starts a shield instance of the proxy in front of origin and
+// returns the configuration of an edge that uses it. The edge's own
+// backends fail the test when contacted.
+func shieldChain(t *testing.T, origin string, env map[string]string) *config {
+	t.Helper()
+	shieldCfg := testConfig(t, origin, env)
+	shield := newBackend(t, routes(shieldCfg, nil).ServeHTTP)
+	direct := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("edge contacted the origin: %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	edgeEnv := map[string]string{"SHIELD_URL": shield.URL}
+	for name, value := range env {
+		edgeEnv[name] = value
+	}
+	return testConfig(t, direct.URL, edgeEnv)
+}
+
+func TestShieldChain(t *testing.T) {
+	const secret = "s3cret"
+	tests := []struct {
+		name       string
+		env        map[string]string
+		target     string
+		header     func(override string) map[string]string
+		wantOrigin string // origin that should serve the request
+		wantPath   string // path that origin was asked for
+	}{
+		{"plain", nil, "/assets/a.txt", nil, "primary", "/assets/a.txt"},
+		{"resized", nil, "/assets/a.png?type=image&w=10", nil, "primary", "/insecure/w:10/plain/"},
+		{"small source", map[string]string{"RESIZE_MIN_SOURCE_SIZE": "1024"}, "/assets/a.png?type=image&w=10", nil, "primary", "/assets/a.png"},
+		{"no-transform", nil, "/assets/a.png?type=image&w=10", func(string) map[string]string {
+			return map[string]string{"Cache-Control": "no-transform"}
+		}, "primary", "/assets/a.png"},
+		{"backend override", map[string]string{"BACKEND_OVERRIDE_SECRET": secret}, "/assets/a.txt", func(override string) map[string]string {
+			return map[string]string{"X-Backend-Override": override + ";" + sign(secret, override)}
+		}, "override", "/assets/a.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotOrigin, gotPath string
+			origin := func(name string) *httptest.Server {
+				return newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+					if r.Method == http.MethodGet {
+						gotOrigin, gotPath = name, r.URL.Path
+					}
+					w.Header().Set("Content-Type", getContentTypeFromFilename(r.URL.Path))
+					w.Write([]byte(name))
+				})
+			}
+			primary, override := origin("primary"), origin("override")
+			env := map[string]string{"BACKEND_OVERRIDE_HOSTS": strings.TrimPrefix(override.URL, "http://")}
+			for name, value := range tt.env {
+				env[name] = value
+			}
+			cfg := shieldChain(t, primary.URL, env)
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.header != nil {
+				for name, value := range tt.header(override.URL) {
+					req.Header.Set(name, value)
+				}
+			}
+
+			rec := serve(cfg, nil, req)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", rec.Code)
+			}
+			if gotOrigin != tt.wantOrigin {
+				t.Errorf("served by %q, want %q", gotOrigin, tt.wantOrigin)
+			}
+			if !strings.HasPrefix(gotPath, tt.wantPath) {
+				t.Errorf("origin asked for %q, want prefix %q", gotPath, tt.wantPath)
+			}
+		})
+	}
+}
+
+// marker appends "+mark" to the body and counts how often it ran.
+type marker struct{ runs *atomic.Int32 }
+
+func (m marker) Transform(contentType string, r io.Reader) (io.Reader, string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, "", err
+	}
+	m.runs.Add(1)
+	return strings.NewReader(string(data) + "+mark"), contentType, nil
+}
+
+func TestShieldTransformsOnce(t *testing.T) {
+	var runs atomic.Int32
+	registerTransformer("mark", []string{"text/plain"}, marker{&runs})
+	t.Cleanup(func() { delete(transformers, "mark") })
+	origin := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("body"))
+	})
+	cfg := shieldChain(t, origin.URL, map[string]string{"TRANSFORMERS": "mark"})
+
+	rec := serve(cfg, nil, httptest.NewRequest(http.MethodGet, "/assets/a.txt", nil))
+
+	if got := rec.Body.String(); got != "body+mark" {
+		t.Errorf("body = %q, want %q", got, "body+mark")
+	}
+	if got := runs.Load(); got != 1 {
+		t.Errorf("transformer ran %d times, want 1", got)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const sniffLen = 512
+
+// executableMagic are signatures of native executables and scripts, which
+// http.DetectContentType reports only as octet-stream or text.
+var executableMagic = [][]byte{
+	[]byte("MZ"),               // Windows PE
+	[]byte("\x7fELF"),          // ELF
+	[]byte("\xcf\xfa\xed\xfe"), // Mach-O
+	[]byte("#!"),               // interpreter script
+}
+
+// dangerousContent sniffs the start of a response claimed to be an image
+// and reports whether it actually looks like HTML, XML or an executable.
+// The sniffed bytes are put back so resp.Body still yields the whole body.
+// SVG legitimately sniffs as XML and is not checked.
+func dangerousContent(resp *http.Response, mediaType string) (bool, error) {
+	if !strings.HasPrefix(mediaType, "image/") || strings.HasPrefix(mediaType, "image/svg+xml") {
+		return false, nil
+	}
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(resp.Body, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	head = head[:n]
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), resp.Body), resp.Body}
+
+	sniffed := http.DetectContentType(head)
+	if strings.HasPrefix(sniffed, "text/html") || strings.HasPrefix(sniffed, "text/xml") {
+		return true, nil
+	}
+	for _, magic := range executableMagic {
+		if bytes.HasPrefix(head, magic) {
+			return true, nil
+		}
+	}
+	trimmed := bytes.TrimSpace(bytes.ToLower(head))
+	return bytes.HasPrefix(trimmed, []byte("<script")), nil
+}
+
+// activeContentTypes can run script or embed other pages when opened
+// directly, unlike images and other passive assets.
+var activeContentTypes = []string{"text/html", "application/xhtml+xml", "image/svg+xml", "text/xml", "application/xml"}
+
+// setHardeningHeaders restricts what active content served from this
+// origin may do. Passive types are left alone.
+func setHardeningHeaders(h http.Header, cfg *config, contentType string) {
+	if !hasContentTypePrefix(contentType, activeContentTypes) {
+		return
+	}
+	for name, value := range map[string]string{
+		"Permissions-Policy": cfg.permissionsPolicy,
+		"X-Frame-Options":    cfg.frameOptions,
+		"Referrer-Policy":    cfg.referrerPolicy,
+	} {
+		if value != "" {
+			h.Set(name, value)
+		}
+	}
+}
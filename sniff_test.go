@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStrictSniffing(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 600)
+	strict := map[string]string{"STRICT_CONTENT_SNIFFING": "true"}
+	tests := []struct {
+		name string
+		env  map[string]string
+		path string
+		body string
+		want int
+	}{
+		{"real image", strict, "a.png", png, http.StatusOK},
+		{"html as image", strict, "a.png", "<!DOCTYPE html><html><script>alert(1)</script>", http.StatusForbidden},
+		{"xml as image", strict, "a.jpg", `<?xml version="1.0"?><x/>`, http.StatusForbidden},
+		{"script as image", strict, "a.gif", "  <SCRIPT>alert(1)</SCRIPT>", http.StatusForbidden},
+		{"windows executable", strict, "a.png", "MZ\x90\x00", http.StatusForbidden},
+		{"elf", strict, "a.webp", "\x7fELF\x02\x01", http.StatusForbidden},
+		{"shell script", strict, "a.png", "#!/bin/sh\nrm -rf /", http.StatusForbidden},
+		{"svg", strict, "a.svg", `<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"/>`, http.StatusOK},
+		{"html as html", strict, "p.html", "<html></html>", http.StatusOK},
+		{"empty image", strict, "a.png", "", http.StatusOK},
+		{"disabled", nil, "a.png", "<html><script>alert(1)</script>", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(tt.body))
+			})
+			cfg := testConfig(t, backend.URL, tt.env)
+			rec := serve(cfg, nil, httptest.NewRequest(http.MethodGet, "/assets/"+tt.path, nil))
+
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if tt.want == http.StatusOK && rec.Body.String() != tt.body {
+				t.Errorf("body was altered: got %d bytes, want %d", rec.Body.Len(), len(tt.body))
+			}
+		})
+	}
+}
+
+func TestHardeningHeaders(t *testing.T) {
+	defaults := map[string]string{
+		"Permissions-Policy": "camera=(), microphone=(), geolocation=(), payment=(), usb=()",
+		"X-Frame-Options":    "DENY",
+		"Referrer-Policy":    "no-referrer",
+	}
+	tests := []struct {
+		name string
+		env  map[string]string
+		path string
+		want map[string]string
+	}{
+		{"html", nil, "page.html", defaults},
+		{"svg", nil, "icon.svg", defaults},
+		{"xml", nil, "feed.xml", defaults},
+		{"image", nil, "photo.png", map[string]string{"Permissions-Policy": "", "X-Frame-Options": "", "Referrer-Policy": ""}},
+		{"stylesheet", nil, "site.css", map[string]string{"Permissions-Policy": "", "X-Frame-Options": "", "Referrer-Policy": ""}},
+		{"configured", map[string]string{"FRAME_OPTIONS": "SAMEORIGIN", "REFERRER_POLICY": "same-origin"}, "page.html", map[string]string{"X-Frame-Options": "SAMEORIGIN", "Referrer-Policy": "same-origin"}},
+		{"disabled", map[string]string{"PERMISSIONS_POLICY": "none", "FRAME_OPTIONS": "none"}, "page.html", map[string]string{"Permissions-Policy": "", "X-Frame-Options": "", "Referrer-Policy": "no-referrer"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", getContentTypeFromFilename(r.URL.Path))
+				w.Write([]byte("<x/>"))
+			})
+			cfg := testConfig(t, backend.URL, tt.env)
+
+			rec := serve(cfg, nil, httptest.NewRequest(http.MethodGet, "/assets/"+tt.path, nil))
+
+			for name, want := range tt.want {
+				if got := rec.Header().Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHardeningHeadersPrecompressed(t *testing.T) {
+	backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, ".br") {
+			t.Errorf("original fetched: %s", r.URL.Path)
+		}
+		w.Write([]byte("brotli"))
+	})
+	cfg := testConfig(t, backend.URL, map[string]string{"PRECOMPRESSED": "true"})
+	req := httptest.NewRequest(http.MethodGet, "/assets/page.html", nil)
+	req.Header.Set("Accept-Encoding", "br")
+
+	rec := serve(cfg, nil, req)
+
+	if got := rec.Header().Get("Content-Encoding"); got != "br" {
+		t.Fatalf("Content-Encoding = %q, want br", got)
+	}
+	if got := rec.Header().Get("X-Frame-Options"); got != "DENY" {
+		t.Errorf("X-Frame-Options = %q, want DENY", got)
+	}
+}
+
+func TestNoSniff(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+	}{
+		{"success", http.StatusOK},
+		{"error", http.StatusNotFound},
+		{"redirect", http.StatusMovedPermanently},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := noSniff(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				writeError(w, r, tt.status, "status")
+			}))
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/assets/a.txt", nil))
+			if got := rec.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+				t.Errorf("X-Content-Type-Options = %q, want nosniff", got)
+			}
+		})
+	}
+}
+
+func TestNoSniffConfig(t *testing.T) {
+	tests := []struct {
+		env  map[string]string
+		want bool
+	}{
+		{nil, true},
+		{map[string]string{"NOSNIFF": "false"}, false},
+		{map[string]string{"NOSNIFF": "true"}, true},
+	}
+	for _, tt := range tests {
+		if cfg := testConfig(t, "http://backend.invalid", tt.env); cfg.noSniff != tt.want {
+			t.Errorf("noSniff with %v = %v, want %v", tt.env, cfg.noSniff, tt.want)
+		}
+	}
+}
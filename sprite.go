@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	spriteLayoutHorizontal = "horizontal"
+	spriteLayoutGrid       = "grid"
+	maxSpritePadding       = 64
+)
+
+var cssClassUnsafe = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+var errIconTooLarge = errors.New("icon dimensions exceed SPRITE_MAX_ICON_DIMENSION")
+
+// spriteLayout places icons of the given sizes on a sprite sheet, separated
+// by padding pixels, and returns each icon's rectangle plus the sheet size.
+// Grid layouts use square-ish rows of cells as large as the biggest icon.
+func spriteLayout(sizes []image.Point, layout string, padding int) ([]image.Rectangle, image.Point) {
+	rects := make([]image.Rectangle, len(sizes))
+	var bounds image.Point
+
+	if layout == spriteLayoutGrid {
+		var cell image.Point
+		for _, size := range sizes {
+			cell.X = max(cell.X, size.X)
+			cell.Y = max(cell.Y, size.Y)
+		}
+		columns := int(math.Ceil(math.Sqrt(float64(len(sizes)))))
+		for i, size := range sizes {
+			origin := image.Pt((i%columns)*(cell.X+padding), (i/columns)*(cell.Y+padding))
+			rects[i] = image.Rectangle{Min: origin, Max: origin.Add(size)}
+			bounds.X = max(bounds.X, origin.X+cell.X)
+			bounds.Y = max(bounds.Y, origin.Y+cell.Y)
+		}
+		return rects, bounds
+	}
+
+	for i, size := range sizes {
+		origin := image.Pt(bounds.X, 0)
+		if i > 0 {
+			origin.X += padding
+		}
+		rects[i] = image.Rectangle{Min: origin, Max: origin.Add(size)}
+		bounds.X = rects[i].Max.X
+		bounds.Y = max(bounds.Y, size.Y)
+	}
+	return rects, bounds
+}
+
+// spriteCSS writes one rule per icon positioning the sprite image so that
+// only that icon shows. Class names come from the icon file names.
+func spriteCSS(spriteURL string, names []string, rects []image.Rectangle) []byte {
+	var buf bytes.Buffer
+	for i, name := range names {
+		rect := rects[i]
+		fmt.Fprintf(&buf, ".icon-%s{background:url(%q) %s %s no-repeat;width:%dpx;height:%dpx}\n",
+			name, spriteURL, cssOffset(rect.Min.X), cssOffset(rect.Min.Y), rect.Dx(), rect.Dy())
+	}
+	return buf.Bytes()
+}
+
+func cssOffset(n int) string {
+	if n == 0 {
+		return "0"
+	}
+	return fmt.Sprintf("-%dpx", n)
+}
+
+func iconClassName(iconPath string) string {
+	name := strings.TrimSuffix(path.Base(iconPath), path.Ext(iconPath))
+	return strings.Trim(cssClassUnsafe.ReplaceAllString(name, "-"), "-")
+}
+
+// spriteHandler composes the icons listed in ?icons=a.png,b.png (paths on
+// the asset backend) into a single PNG sprite, or with ?format=css returns
+// the matching stylesheet. ?layout= and ?padding= override the defaults.
+// spriteParams lists the query parameters of a sprite request.
+var spriteParams = []string{"icons", "layout", "format"}
+
+func spriteHandler(cfg *config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if cfg.duplicateParams == duplicateParamsReject {
+			if name := duplicateParam(q, spriteParams); name != "" {
+				writeError(w, r, http.StatusBadRequest, fmt.Sprintf("duplicate query parameter: %s", name))
+				return
+			}
+		}
+
+		// The sheet re-encodes the icons, so it gets the same hotlink
+		// protection as serving them from /assets.
+		if len(cfg.hotlinkAllowedHosts) > 0 && q.Get("format") != "css" {
+			w.Header().Set("Vary", "Referer, Origin")
+			if !hotlinkAllowed(r, cfg) {
+				writeError(w, r, http.StatusForbidden, "hotlinking is not allowed")
+				return
+			}
+		}
+
+		icons := strings.Split(q.Get("icons"), ",")
+		if q.Get("icons") == "" || len(icons) > cfg.spriteMaxIcons {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("icons must list between 1 and %d assets", cfg.spriteMaxIcons))
+			return
+		}
+
+		layout := cfg.spriteLayout
+		if value := q.Get("layout"); value != "" {
+			if value != spriteLayoutHorizontal && value != spriteLayoutGrid {
+				writeError(w, r, http.StatusBadRequest, "layout must be horizontal or grid")
+				return
+			}
+			layout = value
+		}
+
+		padding := cfg.spritePadding
+		if value := q.Get("padding"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 || n > maxSpritePadding {
+				writeError(w, r, http.StatusBadRequest, fmt.Sprintf("padding must be between 0 and %d", maxSpritePadding))
+				return
+			}
+			padding = n
+		}
+
+		images := make([]image.Image, len(icons))
+		sizes := make([]image.Point, len(icons))
+		names := make([]string, len(icons))
+		cacheControl := cacheMaxAge
+		for i, icon := range icons {
+			icon = strings.Trim(icon, "/")
+			if icon == "" || isValidURL(icon) {
+				writeError(w, r, http.StatusBadRequest, "icons must be asset paths")
+				return
+			}
+			img, err := fetchIcon(r, cfg, icon)
+			if err == errIconTooLarge {
+				writeError(w, r, http.StatusUnprocessableEntity, fmt.Sprintf("icon %s is larger than %dx%d", icon, cfg.spriteMaxIconDimension, cfg.spriteMaxIconDimension))
+				return
+			}
+			if err != nil {
+				writeError(w, r, http.StatusBadGateway, fmt.Sprintf("Error fetching icon %s", icon))
+				return
+			}
+			images[i] = img
+			sizes[i] = img.Bounds().Size()
+			names[i] = iconClassName(icon)
+			// The sheet contains every icon, so one no-store icon makes
+			// the whole sprite no-store.
+			if cacheControlFor(cfg, icon) == cacheNoStore {
+				cacheControl = cacheNoStore
+			}
+		}
+
+		rects, bounds := spriteLayout(sizes, layout, padding)
+		if bounds.X > cfg.spriteMaxSheetDimension || bounds.Y > cfg.spriteMaxSheetDimension {
+			writeError(w, r, http.StatusUnprocessableEntity, fmt.Sprintf("sprite would be larger than %dx%d", cfg.spriteMaxSheetDimension, cfg.spriteMaxSheetDimension))
+			return
+		}
+
+		if q.Get("format") == "css" {
+			spriteURL := *r.URL
+			spriteQuery := spriteURL.Query()
+			spriteQuery.Del("format")
+			spriteURL.RawQuery = spriteQuery.Encode()
+			w.Header().Set("Content-Type", "text/css; charset=utf-8")
+			w.Header().Set("Cache-Control", cacheControl)
+			writeBody(w, r, http.StatusOK, spriteCSS(spriteURL.RequestURI(), names, rects))
+			return
+		}
+
+		sheet := image.NewNRGBA(image.Rectangle{Max: bounds})
+		for i, img := range images {
+			draw.Draw(sheet, rects[i], img, img.Bounds().Min, draw.Src)
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, sheet); err != nil {
+			writeError(w, r, http.StatusInternalServerError, "Error encoding sprite")
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+		w.Header().Set("Cache-Control", cacheControl)
+		setCrossOriginHeaders(w.Header(), cfg)
+		w.Write(buf.Bytes())
+	}
+}
+
+func fetchIcon(r *http.Request, cfg *config, icon string) (image.Image, error) {
+	t := target{url: fmt.Sprintf("%s/assets/%s", cfg.assetsApiHost, icon), backend: backendAssets}
+	// Icons are decoded whole, whatever range the sprite was asked for.
+	header := upstreamHeaders(r, cfg, t)
+	header.Del("Range")
+	header.Del("If-Range")
+	resp, err := fetchAsset(r.Context(), t.url, t.backend, header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, cfg.spriteMaxIconSize))
+	if err != nil {
+		return nil, err
+	}
+	// Check the declared size before decoding allocates the pixels.
+	imgCfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if imgCfg.Width > cfg.spriteMaxIconDimension || imgCfg.Height > cfg.spriteMaxIconDimension {
+		return nil, errIconTooLarge
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// solidPNG encodes a width x height PNG filled with c.
+func solidPNG(t *testing.T, width, height int, c color.Color) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// bombPNG returns a tiny PNG whose header declares width x height pixels,
+// which decoding would allocate up front.
+func bombPNG(t *testing.T, width, height uint32) []byte {
+	t.Helper()
+	data := solidPNG(t, 1, 1, red)
+	// The IHDR chunk follows the 8-byte signature: length, type, then
+	// width and height, with its CRC after the 13 data bytes.
+	ihdr := data[12 : 12+4+13]
+	binary.BigEndian.PutUint32(ihdr[4:], width)
+	binary.BigEndian.PutUint32(ihdr[8:], height)
+	binary.BigEndian.PutUint32(data[12+4+13:], crc32.ChecksumIEEE(ihdr))
+	return data
+}
+
+var (
+	red  = color.NRGBA{R: 255, A: 255}
+	blue = color.NRGBA{B: 255, A: 255}
+)
+
+// iconBackend serves the given files under /assets/ and 404 otherwise.
+func iconBackend(t *testing.T, files map[string][]byte) *httptest.Server {
+	return newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[strings.TrimPrefix(r.URL.Path, "/assets/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	})
+}
+
+func TestSprite(t *testing.T) {
+	files := map[string][]byte{
+		"icons/a.png":    solidPNG(t, 4, 4, red),
+		"icons/b.png":    solidPNG(t, 2, 6, blue),
+		"icons/c.png":    solidPNG(t, 4, 4, red),
+		"icons/big.png":  solidPNG(t, 600, 1, red),
+		"icons/bomb.png": bombPNG(t, 60000, 60000),
+		"notes.txt":      []byte("not an image"),
+	}
+	tests := []struct {
+		name       string
+		env        map[string]string
+		query      string
+		wantStatus int
+		wantSize   image.Point
+	}{
+		{"horizontal", nil, "icons=icons/a.png,icons/b.png", http.StatusOK, image.Pt(6, 6)},
+		{"horizontal padding", nil, "icons=icons/a.png,icons/b.png&padding=2", http.StatusOK, image.Pt(8, 6)},
+		{"grid", nil, "icons=icons/a.png,icons/b.png,icons/c.png&layout=grid", http.StatusOK, image.Pt(8, 12)},
+		{"grid padding", nil, "icons=icons/a.png,icons/b.png,icons/c.png&layout=grid&padding=1", http.StatusOK, image.Pt(9, 13)},
+		{"configured layout", map[string]string{"SPRITE_LAYOUT": "grid"}, "icons=icons/a.png,icons/b.png,icons/c.png", http.StatusOK, image.Pt(8, 12)},
+		{"no icons", nil, "", http.StatusBadRequest, image.Point{}},
+		{"too many icons", map[string]string{"SPRITE_MAX_ICONS": "1"}, "icons=icons/a.png,icons/b.png", http.StatusBadRequest, image.Point{}},
+		{"absolute url", nil, "icons=http://example.com/a.png", http.StatusBadRequest, image.Point{}},
+		{"empty entry", nil, "icons=icons/a.png,", http.StatusBadRequest, image.Point{}},
+		{"bad layout", nil, "icons=icons/a.png&layout=vertical", http.StatusBadRequest, image.Point{}},
+		{"bad padding", nil, "icons=icons/a.png&padding=100", http.StatusBadRequest, image.Point{}},
+		{"missing icon", nil, "icons=icons/a.png,icons/none.png", http.StatusBadGateway, image.Point{}},
+		{"not an image", nil, "icons=notes.txt", http.StatusBadGateway, image.Point{}},
+		{"icon too large", nil, "icons=icons/big.png", http.StatusUnprocessableEntity, image.Point{}},
+		{"decode bomb", nil, "icons=icons/bomb.png", http.StatusUnprocessableEntity, image.Point{}},
+		{"icon over configured size", map[string]string{"SPRITE_MAX_ICON_DIMENSION": "3"}, "icons=icons/a.png", http.StatusUnprocessableEntity, image.Point{}},
+		{"sheet too large", map[string]string{"SPRITE_MAX_SHEET_DIMENSION": "5"}, "icons=icons/a.png,icons/b.png", http.StatusUnprocessableEntity, image.Point{}},
+		{"icon bytes capped", map[string]string{"SPRITE_MAX_ICON_SIZE": "16"}, "icons=icons/a.png", http.StatusBadGateway, image.Point{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t, iconBackend(t, files).URL, tt.env)
+
+			rec := serve(cfg, nil, httptest.NewRequest(http.MethodGet, "/sprite?"+tt.query, nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if got := rec.Header().Get("Content-Type"); got != "image/png" {
+				t.Errorf("Content-Type = %q, want image/png", got)
+			}
+			if got := rec.Header().Get("Cache-Control"); got != cacheMaxAge {
+				t.Errorf("Cache-Control = %q, want %q", got, cacheMaxAge)
+			}
+			sheet, err := png.Decode(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := sheet.Bounds().Size(); got != tt.wantSize {
+				t.Errorf("sheet size = %v, want %v", got, tt.wantSize)
+			}
+		})
+	}
+}
+
+func TestSpritePixels(t *testing.T) {
+	files := map[string][]byte{
+		"a.png": solidPNG(t, 4, 4, red),
+		"b.png": solidPNG(t, 2, 6, blue),
+	}
+	cfg := testConfig(t, iconBackend(t, files).URL, nil)
+
+	rec := serve(cfg, nil, httptest.NewRequest(http.MethodGet, "/sprite?icons=a.png,b.png&padding=1", nil))
+	sheet, err := png.Decode(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		x, y int
+		want color.Color
+	}{
+		{0, 0, red},
+		{3, 3, red},
+		{4, 0, color.NRGBA{}}, // padding
+		{0, 5, color.NRGBA{}}, // below the shorter icon
+		{5, 0, blue},
+		{6, 5, blue},
+	}
+	for _, tt := range tests {
+		if got := color.NRGBAModel.Convert(sheet.At(tt.x, tt.y)); got != tt.want {
+			t.Errorf("pixel (%d, %d) = %v, want %v", tt.x, tt.y, got, tt.want)
+		}
+	}
+}
+
+func TestSpriteCSS(t *testing.T) {
+	files := map[string][]byte{
+		"icons/home.png":       solidPNG(t, 4, 4, red),
+		"icons/arrow left.png": solidPNG(t, 2, 6, blue),
+	}
+	cfg := testConfig(t, iconBackend(t, files).URL, nil)
+
+	rec := serve(cfg, nil, httptest.NewRequest(http.MethodGet, "/sprite?icons=icons/home.png,icons/arrow%20left.png&format=css", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "text/css; charset=utf-8" {
+		t.Errorf("Content-Type = %q", got)
+	}
+	want := `.icon-home{background:url("/sprite?icons=icons%2Fhome.png%2Cicons%2Farrow+left.png") 0 0 no-repeat;width:4px;height:4px}
+.icon-arrow-left{background:url("/sprite?icons=icons%2Fhome.png%2Cicons%2Farrow+left.png") -4px 0 no-repeat;width:2px;height:6px}
+`
+	if rec.Body.String() != want {
+		t.Errorf("css =\n%s\nwant\n%s", rec.Body, want)
+	}
+}
+
+func TestSpriteLayout(t *testing.T) {
+	sizes := []image.Point{{4, 4}, {2, 6}, {3, 3}}
+	tests := []struct {
+		name    string
+		layout  string
+		padding int
+		want    []image.Rectangle
+		bounds  image.Point
+	}{
+		{"horizontal", spriteLayoutHorizontal, 0, []image.Rectangle{image.Rect(0, 0, 4, 4), image.Rect(4, 0, 6, 6), image.Rect(6, 0, 9, 3)}, image.Pt(9, 6)},
+		{"horizontal padded", spriteLayoutHorizontal, 2, []image.Rectangle{image.Rect(0, 0, 4, 4), image.Rect(6, 0, 8, 6), image.Rect(10, 0, 13, 3)}, image.Pt(13, 6)},
+		{"grid", spriteLayoutGrid, 0, []image.Rectangle{image.Rect(0, 0, 4, 4), image.Rect(4, 0, 6, 6), image.Rect(0, 6, 3, 9)}, image.Pt(8, 12)},
+		{"grid padded", spriteLayoutGrid, 1, []image.Rectangle{image.Rect(0, 0, 4, 4), image.Rect(5, 0, 7, 6), image.Rect(0, 7, 3, 10)}, image.Pt(9, 13)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rects, bounds := spriteLayout(sizes, tt.layout, tt.padding)
+			for i := range rects {
+				if rects[i] != tt.want[i] {
+					t.Errorf("icon %d at %v, want %v", i, rects[i], tt.want[i])
+				}
+			}
+			if bounds != tt.bounds {
+				t.Errorf("bounds = %v, want %v", bounds, tt.bounds)
+			}
+		})
+	}
+}
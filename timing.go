@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// serverTiming collects the phases of an asset request for the
+// Server-Timing header. Only phases that actually ran are reported.
+type serverTiming struct {
+	start  time.Time
+	phases []string
+}
+
+func newServerTiming() *serverTiming {
+	return &serverTiming{start: time.Now()}
+}
+
+// measure records the phase name as having run from since until now.
+func (s *serverTiming) measure(name string, since time.Time) {
+	s.phases = append(s.phases, timingMetric(name, time.Since(since)))
+}
+
+// header returns the recorded phases followed by the total time so far.
+// The fetch phase ends when the backend's headers arrive; streaming the
+// body happens after the header is sent and is not included.
+func (s *serverTiming) header() string {
+	return strings.Join(append(s.phases, timingMetric("total", time.Since(s.start))), ", ")
+}
+
+func timingMetric(name string, d time.Duration) string {
+	return fmt.Sprintf("%s;dur=%.1f", name, float64(d.Microseconds())/1000)
+}
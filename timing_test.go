@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestTimingMetric(t *testing.T) {
+	tests := []struct {
+		name string
+		d    time.Duration
+		want string
+	}{
+		{"fetch", 0, "fetch;dur=0.0"},
+		{"fetch", 1500 * time.Microsecond, "fetch;dur=1.5"},
+		{"total", 2 * time.Second, "total;dur=2000.0"},
+		{"transform", 999 * time.Nanosecond, "transform;dur=0.0"},
+	}
+	for _, tt := range tests {
+		if got := timingMetric(tt.name, tt.d); got != tt.want {
+			t.Errorf("timingMetric(%q, %v) = %q, want %q", tt.name, tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestServerTimingHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		path string
+		want string // pattern, empty for no header
+	}{
+		{"disabled", nil, "a.txt", ""},
+		{"raw asset", map[string]string{"SERVER_TIMING": "true"}, "a.txt", `^fetch;dur=\d+\.\d, total;dur=\d+\.\d$`},
+		{"transformed", map[string]string{"SERVER_TIMING": "true", "TRANSFORMERS": "json-compact"}, "a.json", `^fetch;dur=\d+\.\d, transform;dur=\d+\.\d, total;dur=\d+\.\d$`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", getContentTypeFromFilename(r.URL.Path))
+				w.Write([]byte(`{"a": 1}`))
+			})
+			cfg := testConfig(t, backend.URL, tt.env)
+
+			rec := serve(cfg, nil, httptest.NewRequest(http.MethodGet, "/assets/"+tt.path, nil))
+
+			got := rec.Header().Get("Server-Timing")
+			if tt.want == "" {
+				if got != "" {
+					t.Errorf("Server-Timing = %q, want none", got)
+				}
+				return
+			}
+			if !regexp.MustCompile(tt.want).MatchString(got) {
+				t.Errorf("Server-Timing = %q, want %s", got, tt.want)
+			}
+		})
+	}
+}
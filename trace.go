@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// childTraceparent derives the W3C traceparent for an upstream request from
+// the client's: same trace ID and flags, with a fresh parent (span) ID so the
+// backend call shows up as a child span. Malformed values are dropped.
+func childTraceparent(value string) (string, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		!isHex(parts[0]) || !isHex(parts[1]) || !isHex(parts[2]) || !isHex(parts[3]) ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 ||
+		parts[1] == strings.Repeat("0", 32) || parts[2] == strings.Repeat("0", 16) {
+		return "", false
+	}
+	// Versions above 00 may append fields; only the 00 layout is forwarded.
+	if parts[0] == "00" && len(parts) != 4 {
+		return "", false
+	}
+	spanID := make([]byte, 8)
+	rand.Read(spanID)
+	return "00-" + parts[1] + "-" + hex.EncodeToString(spanID) + "-" + parts[3], true
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// setTraceHeaders propagates the client's trace context to a backend
+// request. tracestate is only meaningful alongside a valid traceparent.
+func setTraceHeaders(h http.Header, r *http.Request) {
+	traceparent, ok := childTraceparent(r.Header.Get("Traceparent"))
+	if !ok {
+		return
+	}
+	h.Set("Traceparent", traceparent)
+	if state := r.Header.Values("Tracestate"); len(state) > 0 {
+		h.Set("Tracestate", strings.Join(state, ","))
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+func TestChildTraceparent(t *testing.T) {
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+	tests := []struct {
+		name   string
+		value  string
+		wantOK bool
+		flags  string
+	}{
+		{"sampled", "00-" + traceID + "-" + spanID + "-01", true, "01"},
+		{"not sampled", "00-" + traceID + "-" + spanID + "-00", true, "00"},
+		{"surrounding space", " 00-" + traceID + "-" + spanID + "-01 ", true, "01"},
+		{"future version with extra field", "01-" + traceID + "-" + spanID + "-01-extra", true, "01"},
+		{"version 00 with extra field", "00-" + traceID + "-" + spanID + "-01-extra", false, ""},
+		{"invalid version", "ff-" + traceID + "-" + spanID + "-01", false, ""},
+		{"uppercase", "00-" + strings.ToUpper(traceID) + "-" + spanID + "-01", false, ""},
+		{"zero trace id", "00-" + strings.Repeat("0", 32) + "-" + spanID + "-01", false, ""},
+		{"zero span id", "00-" + traceID + "-" + strings.Repeat("0", 16) + "-01", false, ""},
+		{"short trace id", "00-" + traceID[:30] + "-" + spanID + "-01", false, ""},
+		{"missing flags", "00-" + traceID + "-" + spanID, false, ""},
+		{"empty", "", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := childTraceparent(tt.value)
+			if ok != tt.wantOK {
+				t.Fatalf("childTraceparent(%q) ok = %v, want %v", tt.value, ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			parts := strings.Split(got, "-")
+			if len(parts) != 4 || parts[0] != "00" || parts[1] != traceID || parts[3] != tt.flags {
+				t.Errorf("childTraceparent(%q) = %q, want the same trace and flags %s", tt.value, got, tt.flags)
+			}
+			if len(parts[2]) != 16 || !isHex(parts[2]) || parts[2] == spanID {
+				t.Errorf("span id = %q, want a fresh one", parts[2])
+			}
+		})
+	}
+}
+
+func TestTraceForwarded(t *testing.T) {
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	tests := []struct {
+		name       string
+		header     map[string][]string
+		wantParent bool
+		wantState  string
+	}{
+		{"traceparent and state", map[string][]string{"Traceparent": {traceparent}, "Tracestate": {"a=1", "b=2"}}, true, "a=1,b=2"},
+		{"traceparent only", map[string][]string{"Traceparent": {traceparent}}, true, ""},
+		{"state without traceparent", map[string][]string{"Tracestate": {"a=1"}}, false, ""},
+		{"malformed traceparent", map[string][]string{"Traceparent": {"garbage"}, "Tracestate": {"a=1"}}, false, ""},
+	}
+	upstreams := []struct {
+		name string
+		path string
+	}{
+		{"asset backend", "/assets/a.txt"},
+		{"resizer", "/assets/photo.png?type=image&w=10"},
+		{"sprite icon", "/sprite?icons=a.png"},
+		{"manifest variant", "/manifest/photo.png"},
+	}
+	for _, tt := range tests {
+		for _, upstream := range upstreams {
+			t.Run(tt.name+"/"+upstream.name, func(t *testing.T) {
+				var got http.Header
+				backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+					got = r.Header.Clone()
+				})
+				cfg := testConfig(t, backend.URL, map[string]string{"VARIANT_WIDTHS": "320"})
+				req := httptest.NewRequest(http.MethodGet, upstream.path, nil)
+				for name, values := range tt.header {
+					req.Header[name] = values
+				}
+
+				serve(cfg, nil, req)
+
+				if parent := got.Get("Traceparent"); (parent != "") != tt.wantParent || parent == traceparent {
+					t.Errorf("Traceparent = %q, want a child span: %v", parent, tt.wantParent)
+				}
+				if state := got.Get("Tracestate"); state != tt.wantState {
+					t.Errorf("Tracestate = %q, want %q", state, tt.wantState)
+				}
+				if got.Get(middleware.RequestIDHeader) == "" {
+					t.Errorf("%s not forwarded", middleware.RequestIDHeader)
+				}
+			})
+		}
+	}
+}
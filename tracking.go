@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// isTrackingParam reports whether name matches one of TRACKING_PARAMS,
+// where a trailing * matches any suffix, as in utm_*.
+func isTrackingParam(name string, patterns []string) bool {
+	name = strings.ToLower(name)
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok && strings.HasPrefix(name, prefix) || name == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// stripTracking removes tracking parameters from the request query and
+// from the query of an embedded source URL, which is returned. Shared
+// links then map to the same upstream URL, ETag and shield request, and
+// the parameters never reach a backend.
+func stripTracking(r *http.Request, urlPath string, patterns []string) string {
+	if q := r.URL.Query(); removeTracking(q, patterns) {
+		r.URL.RawQuery = q.Encode()
+	}
+	if !isValidURL(urlPath) {
+		return urlPath
+	}
+	u, err := url.Parse(urlPath)
+	if err != nil {
+		return urlPath
+	}
+	if q := u.Query(); removeTracking(q, patterns) {
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+	return urlPath
+}
+
+func removeTracking(q url.Values, patterns []string) bool {
+	removed := false
+	for name := range q {
+		if isTrackingParam(name, patterns) {
+			delete(q, name)
+			removed = true
+		}
+	}
+	return removed
+}
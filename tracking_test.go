@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestIsTrackingParam(t *testing.T) {
+	patterns := []string{"utm_*", "fbclid", "_ga"}
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"utm_source", true},
+		{"UTM_Campaign", true},
+		{"utm_", true},
+		{"fbclid", true},
+		{"FBCLID", true},
+		{"_ga", true},
+		{"_gat", false},
+		{"fbclid2", false},
+		{"utm", false},
+		{"w", false},
+	}
+	for _, tt := range tests {
+		if got := isTrackingParam(tt.name, patterns); got != tt.want {
+			t.Errorf("isTrackingParam(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestStripTracking(t *testing.T) {
+	patterns := []string{"utm_*", "fbclid"}
+	tests := []struct {
+		name      string
+		query     string
+		urlPath   string
+		wantQuery string
+		wantPath  string
+	}{
+		{"request query", "w=100&utm_source=x&fbclid=y", "a.png", "w=100", "a.png"},
+		{"nothing to strip", "w=100&v=2", "a.png", "w=100&v=2", "a.png"},
+		{"source url", "type=image", "https://img.example/a.png?utm_medium=m&sig=s", "type=image", "https://img.example/a.png?sig=s"},
+		{"source url untouched", "", "https://img.example/a.png?sig=s", "", "https://img.example/a.png?sig=s"},
+		{"source url only tracking", "", "https://img.example/a.png?fbclid=1", "", "https://img.example/a.png"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/assets/a?"+tt.query, nil)
+			got := stripTracking(r, tt.urlPath, patterns)
+			if got != tt.wantPath {
+				t.Errorf("path = %q, want %q", got, tt.wantPath)
+			}
+			if r.URL.RawQuery != tt.wantQuery {
+				t.Errorf("query = %q, want %q", r.URL.RawQuery, tt.wantQuery)
+			}
+		})
+	}
+}
+
+func TestTrackingParamsStripped(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       map[string]string
+		query     string
+		wantQuery string
+	}{
+		{"defaults", nil, "v=1&utm_source=news&gclid=abc", "v=1"},
+		{"configured", map[string]string{"TRACKING_PARAMS": "ref"}, "v=1&ref=x&utm_source=news", "utm_source=news&v=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				got = r.URL.RawQuery
+			})
+			cfg := testConfig(t, backend.URL, tt.env)
+
+			serve(cfg, nil, httptest.NewRequest(http.MethodGet, "/assets/"+url.QueryEscape(backend.URL+"/a.txt?"+tt.query), nil))
+
+			if got != tt.wantQuery {
+				t.Errorf("backend query = %q, want %q", got, tt.wantQuery)
+			}
+		})
+	}
+}
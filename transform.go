@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Transformer rewrites a response body on its way to the client, for
+// example to minify or watermark it. It returns the new body and content
+// type; an error leaves the original response untouched.
+type Transformer interface {
+	Transform(contentType string, r io.Reader) (io.Reader, string, error)
+}
+
+type transformerEntry struct {
+	contentTypes []string // content type prefixes the transformer applies to
+	transformer  Transformer
+}
+
+var errTransformTooLarge = errors.New("output exceeds TRANSFORM_MAX_SIZE")
+
+// transformers holds every available transformer by name. TRANSFORMERS
+// selects which of them run, in the order listed.
+var transformers = map[string]transformerEntry{
+	"json-compact": {contentTypes: []string{"application/json"}, transformer: jsonCompact{}},
+}
+
+// registerTransformer makes a transformer available to TRANSFORMERS under
+// name. It must be called before loadConfig.
+func registerTransformer(name string, contentTypes []string, t Transformer) {
+	transformers[name] = transformerEntry{contentTypes: contentTypes, transformer: t}
+}
+
+// jsonCompact strips insignificant whitespace from JSON documents.
+type jsonCompact struct{}
+
+func (jsonCompact) Transform(contentType string, r io.Reader) (io.Reader, string, error) {
+	src, err := io.ReadAll(r)
+	if err != nil {
+		return nil, "", err
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, src); err != nil {
+		return nil, "", err
+	}
+	return &buf, contentType, nil
+}
+
+// applyTransforms runs the enabled transformers that match the response's
+// content type. Bodies are buffered first, so only complete 200 responses
+// of at most TRANSFORM_MAX_SIZE bytes are transformed; larger ones are
+// streamed unchanged, as is anything the client or backend marked
+// no-transform. A failing transformer is logged and skipped. It
+// reports whether any transformer ran.
+func applyTransforms(r *http.Request, cfg *config, resp *http.Response, mediaType string) (bool, error) {
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Encoding") != "" && !resp.Uncompressed {
+		return false, nil
+	}
+	if hasCacheDirective(r.Header, "no-transform") || hasCacheDirective(resp.Header, "no-transform") {
+		return false, nil
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = mediaType
+	}
+
+	var body []byte
+	for _, name := range cfg.transformers {
+		entry := transformers[name]
+		if !hasContentTypePrefix(contentType, entry.contentTypes) {
+			continue
+		}
+		if body == nil {
+			buffered, err := bufferBody(resp, cfg.transformMaxSize)
+			if err != nil || !buffered {
+				return false, err
+			}
+			body, _ = io.ReadAll(resp.Body)
+		}
+		out, newType, err := entry.transformer.Transform(contentType, bytes.NewReader(body))
+		if err == nil {
+			var transformed []byte
+			if transformed, err = io.ReadAll(io.LimitReader(out, cfg.transformMaxSize+1)); err == nil && int64(len(transformed)) > cfg.transformMaxSize {
+				err = errTransformTooLarge
+			}
+			if err == nil {
+				body, contentType = transformed, newType
+				continue
+			}
+		}
+		log.Printf("transformer %s: %s", name, err)
+	}
+	if body != nil {
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		resp.Header.Set("Content-Type", contentType)
+	}
+	return body != nil, nil
+}
+
+// transformable reports whether an enabled transformer may rewrite assets
+// of mediaType. Such assets are never fetched by range, since a range of
+// the original says nothing about the transformed body.
+func transformable(cfg *config, mediaType string) bool {
+	for _, name := range cfg.transformers {
+		if hasContentTypePrefix(mediaType, transformers[name].contentTypes) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasContentTypePrefix(contentType string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(strings.ToLower(contentType), strings.ToLower(prefix)) {
+			return true
+		}
+	}
+	return false
+}
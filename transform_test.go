@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// upper uppercases text bodies.
+type upper struct{}
+
+func (upper) Transform(contentType string, r io.Reader) (io.Reader, string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, "", err
+	}
+	return strings.NewReader(strings.ToUpper(string(data))), contentType, nil
+}
+
+// failing always fails.
+type failing struct{}
+
+func (failing) Transform(contentType string, r io.Reader) (io.Reader, string, error) {
+	return nil, "", errors.New("broken")
+}
+
+// repeat doubles the body.
+type repeat struct{}
+
+func (repeat) Transform(contentType string, r io.Reader) (io.Reader, string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, "", err
+	}
+	return strings.NewReader(string(data) + string(data)), contentType, nil
+}
+
+func TestTransformers(t *testing.T) {
+	for name, tr := range map[string]Transformer{"upper": upper{}, "failing": failing{}, "repeat": repeat{}} {
+		registerTransformer(name, []string{"text/plain"}, tr)
+		t.Cleanup(func() { delete(transformers, name) })
+	}
+	tests := []struct {
+		name         string
+		transformers string
+		maxSize      string
+		path         string
+		contentType  string
+		body         string
+		header       map[string]string
+		want         string
+	}{
+		{"json compact", "json-compact", "", "a.json", "application/json", `{ "a": [1, 2] }`, nil, `{"a":[1,2]}`},
+		{"invalid json left alone", "json-compact", "", "a.json", "application/json", `{ "a": `, nil, `{ "a": `},
+		{"type not matched", "upper", "", "a.json", "application/json", `{"a":1}`, nil, `{"a":1}`},
+		{"chained in order", "upper,repeat", "", "a.txt", "text/plain", "ab", nil, "ABAB"},
+		{"failing skipped", "failing,upper", "", "a.txt", "text/plain", "ab", nil, "AB"},
+		{"input over max size", "upper", "4", "a.txt", "text/plain", "abcde", nil, "abcde"},
+		{"output over max size", "repeat,upper", "4", "a.txt", "text/plain", "abc", nil, "ABC"},
+		{"backend no-transform", "upper", "", "a.txt", "text/plain", "ab", map[string]string{"Cache-Control": "max-age=60, no-transform"}, "ab"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := newBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				for name, value := range tt.header {
+					w.Header().Set(name, value)
+				}
+				w.Write([]byte(tt.body))
+			})
+			env := map[string]string{"TRANSFORMERS": tt.transformers}
+			if tt.maxSize != "" {
+				env["TRANSFORM_MAX_SIZE"] = tt.maxSize
+			}
+			cfg := testConfig(t, backend.URL, env)
+
+			rec := serve(cfg, nil, httptest.NewRequest(http.MethodGet, "/assets/"+tt.path, nil))
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", rec.Code)
+			}
+			if rec.Body.String() != tt.want {
+				t.Errorf("body = %q, want %q", rec.Body, tt.want)
+			}
+			if got := rec.Header().Get("Content-Length"); got != "" && got != fmt.Sprint(len(tt.want)) {
+				t.Errorf("Content-Length = %q, want %d", got, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestTransformable(t *testing.T) {
+	cfg := &config{transformers: []string{"json-compact"}}
+	tests := []struct {
+		mediaType string
+		want      bool
+	}{
+		{"application/json", true},
+		{"Application/JSON; charset=utf-8", true},
+		{"text/plain", false},
+	}
+	for _, tt := range tests {
+		if got := transformable(cfg, tt.mediaType); got != tt.want {
+			t.Errorf("transformable(%q) = %v, want %v", tt.mediaType, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+)
+
+// version and commit identify the build. They are set at link time:
+//
+//	go build -ldflags "-X main.version=v1.2.3 -X main.commit=abc1234"
+var (
+	version = "dev"
+	commit  = "unknown"
+)
+
+// versionHandler reports which build is running. It only exposes what the
+// X-Proxy-Version header and the image tag already reveal.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	body, _ := json.Marshal(map[string]string{
+		"version": version,
+		"commit":  commit,
+		"go":      runtime.Version(),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	writeBody(w, r, http.StatusOK, append(body, '\n'))
+}
+
+// proxyVersion tags every response with the running build version.
+func proxyVersion(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proxy-Version", version)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+func TestVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+		commit  string
+	}{
+		{"default", "dev", "unknown"},
+		{"linked", "v1.2.3", "abc1234"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldVersion, oldCommit := version, commit
+			t.Cleanup(func() { version, commit = oldVersion, oldCommit })
+			version, commit = tt.version, tt.commit
+
+			handler := proxyVersion(http.HandlerFunc(versionHandler))
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/version", nil))
+
+			if got := rec.Header().Get("X-Proxy-Version"); got != tt.version {
+				t.Errorf("X-Proxy-Version = %q, want %q", got, tt.version)
+			}
+			if got := rec.Header().Get("Cache-Control"); got != "no-store" {
+				t.Errorf("Cache-Control = %q, want no-store", got)
+			}
+			var body map[string]string
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]string{"version": tt.version, "commit": tt.commit, "go": runtime.Version()}
+			for key, value := range want {
+				if body[key] != value {
+					t.Errorf("%s = %q, want %q", key, body[key], value)
+				}
+			}
+		})
+	}
+}